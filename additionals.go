@@ -1,18 +1,113 @@
 package reflux
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"github.com/pkg/errors"
-	bolt "go.etcd.io/bbolt"
+	"reflect"
 	"sync"
+	"time"
 )
 
 var ErrAttBucketNotFound = errors.Errorf("bucket '%s' not found", additionalDataBucket)
 
+var ErrAttrType = errors.New("attribute type mismatch")
+
+// attrSchemaVersion is the first schema version recording the type of the attributes.
+// The attributes written before are decoded as the type requested by GetAttr.
+const attrSchemaVersion uint16 = 2
+
+// AttrTypeError is returned when the type requested for an attribute is not the type it was stored with.
+// It matches ErrAttrType with errors.Is.
+type AttrTypeError struct {
+	Key       string // The key of the attribute
+	Stored    string // The type the attribute was stored with
+	Requested string // The type requested
+}
+
+// Error returns the description of the mismatch.
+func (e *AttrTypeError) Error() string {
+	return fmt.Sprintf("%s: '%s' stored as %s, requested as %s", ErrAttrType, e.Key, e.Stored, e.Requested)
+}
+
+// Unwrap returns ErrAttrType.
+func (e *AttrTypeError) Unwrap() error {
+	return ErrAttrType
+}
+
+// RawAttr is the value returned by Load for an attribute whose type is unknown in this process, such as an
+// attribute written by another program or before the types were recorded. GetAttr decodes it as a given type.
+type RawAttr struct {
+	Type    string // The name of the type of the value, empty for the attributes written before the types were recorded
+	Codec   byte   // The ID of the codec that encoded the value
+	Payload []byte // The encoded value
+}
+
+// attribute is the record of an attribute: its value encoded with the codec of the given ID and the name of its type.
+type attribute struct {
+	Type    string // The name of the type of the value, empty for the attributes written before the types were recorded
+	Codec   byte   // The ID of the codec that encoded the value
+	Payload []byte // The encoded value
+}
+
+// attrEntry is an attribute held in memory, along with its value when it is known.
+type attrEntry struct {
+	attribute
+	value any // The value of the attribute, nil until it is decoded
+}
+
+// attrTypes maps the names of the types stored or requested in this process to the types,
+// so that the attributes loaded from the database can be decoded by Load.
+var attrTypes sync.Map
+
+func init() {
+	for _, v := range []any{
+		false, "", []byte(nil), []string(nil), map[string]string(nil),
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), time.Time{}, time.Duration(0),
+	} {
+		registerAttrType(reflect.TypeOf(v))
+	}
+}
+
+// attrTypeName returns the name identifying a type in the attribute records, qualified by its package path.
+func attrTypeName(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// registerAttrType records the type so the attributes of this type can be decoded by Load.
+func registerAttrType(t reflect.Type) string {
+	name := attrTypeName(t)
+	attrTypes.LoadOrStore(name, t)
+	return name
+}
+
 type attributes struct {
-	m  *sync.Map
-	db *bolt.DB
+	m          *sync.Map
+	db         Store
+	serializer *serializer
+	scope      bucket    // The bucket holding the scopes of this kind, empty for the global attributes
+	name       string    // The name of the scope within the scope bucket, the source path or the run ID
+	scopes     *sync.Map // The scoped attributes by scopeKey, shared by every scope
+}
+
+// scopeKey identifies a scope of attributes.
+type scopeKey struct {
+	scope bucket
+	name  string
+}
+
+// newAttributes returns the global attributes.
+func newAttributes(db Store, serializer *serializer) *attributes {
+	return &attributes{
+		m:          &sync.Map{},
+		db:         db,
+		serializer: serializer,
+		scopes:     &sync.Map{},
+	}
 }
 
 // AttributesMap provides a synchronized map for storing and managing attributes.
@@ -20,18 +115,41 @@ type attributes struct {
 type AttributesMap interface {
 
 	// loadAll loads the additional data from the database into the TransferManager's additionalData map.
-	loadAll(tx *bolt.Tx) error
+	loadAll(tx Tx) error
 
 	// sync synchronizes the additional data in the database with the additional data in the TransferManager's additionalData map.
 	sync() error
 
+	// set stores the value of the given type for the given key.
+	set(key string, t reflect.Type, data any) error
+
+	// get decodes the value of the given key into target, a pointer to a value of the given type.
+	get(key string, t reflect.Type, target any) (bool, error)
+
+	// deleteScope deletes the attributes scoped to the given file, run or transfer within the transaction.
+	deleteScope(tx Tx, scope bucket, name string) error
+
+	// dropScope removes the attributes scoped to the given file, run or transfer from memory.
+	dropScope(scope bucket, name string)
+
+	// File returns the attributes scoped to the file of the given source path.
+	// They are deleted along with the file metadata by FileMetadataMap.Delete.
+	File(sourcePath string) AttributesMap
+
+	// Run returns the attributes scoped to the run of the given ID.
+	Run(runID string) AttributesMap
+
+	// transfer returns the attributes scoped to the transfer of the file of the given key to its server.
+	transfer(key string) AttributesMap
+
 	// GetSlice returns a slice of additional data
 	GetSlice() ([]any, error)
 
 	// StoreOrUpdate stores or updates the additional data in the database.
 	StoreOrUpdate(key string, data any) error
 
-	// Load returns the additional data for the given key.
+	// Load returns the additional data for the given key and whether it exists, like Exists.
+	// After a restart, an attribute whose type is unknown in this process is returned as a RawAttr.
 	Load(key string) (any, bool)
 
 	// Delete deletes the additional data for the given key.
@@ -41,94 +159,344 @@ type AttributesMap interface {
 	Exists(key string) bool
 }
 
+// SetAttr stores or updates the global attribute of the given key, recording its type T.
+// The type parameter must not be an interface type.
+func SetAttr[T any](tm *TransferManager, key string, v T) error {
+	return SetAttrIn(tm.Attributes, key, v)
+}
+
+// GetAttr returns the global attribute of the given key and false if it does not exist.
+// It returns an *AttrTypeError if the attribute was stored with another type than T.
+func GetAttr[T any](tm *TransferManager, key string) (T, bool, error) {
+	return GetAttrIn[T](tm.Attributes, key)
+}
+
+// SetAttrIn is SetAttr for the given attributes, such as the attributes scoped to a file or a run.
+func SetAttrIn[T any](attrs AttributesMap, key string, v T) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Interface {
+		return errors.Errorf("attribute '%s': interface type %s cannot be stored", key, t)
+	}
+	return attrs.set(key, t, v)
+}
+
+// GetAttrIn is GetAttr for the given attributes, such as the attributes scoped to a file or a run.
+func GetAttrIn[T any](attrs AttributesMap, key string) (T, bool, error) {
+	var v T
+	ok, err := attrs.get(key, reflect.TypeOf((*T)(nil)).Elem(), &v)
+	return v, ok, err
+}
+
+// File returns the attributes scoped to the file of the given source path.
+func (at *attributes) File(sourcePath string) AttributesMap {
+	return at.scoped(fileAttributesBucket, sourcePath)
+}
+
+// Run returns the attributes scoped to the run of the given ID.
+func (at *attributes) Run(runID string) AttributesMap {
+	return at.scoped(runAttributesBucket, runID)
+}
+
+// transfer returns the attributes scoped to the transfer of the file of the given key to its server.
+func (at *attributes) transfer(key string) AttributesMap {
+	return at.scoped(transferAttributesBucket, key)
+}
+
+// scoped returns the attributes of the given scope, they are created empty if they were not loaded.
+func (at *attributes) scoped(scope bucket, name string) *attributes {
+	scoped, _ := at.scopes.LoadOrStore(scopeKey{scope: scope, name: name}, &attributes{
+		m:          &sync.Map{},
+		db:         at.db,
+		serializer: at.serializer,
+		scope:      scope,
+		name:       name,
+		scopes:     at.scopes,
+	})
+	return scoped.(*attributes)
+}
+
+// bucket returns the bucket of the attributes. The bucket of a scope is created if create is true,
+// otherwise nil is returned if it does not exist.
+func (at *attributes) bucket(tx Tx, create bool) (Bucket, error) {
+	if at.scope == "" {
+		b := tx.Bucket(additionalDataBucket.Bytes())
+		if b == nil {
+			return nil, ErrAttBucketNotFound
+		}
+		return b, nil
+	}
+
+	if !create {
+		root := tx.Bucket(at.scope.Bytes())
+		if root == nil {
+			return nil, nil
+		}
+		return root.Bucket([]byte(at.name)), nil
+	}
+
+	root, err := tx.CreateBucketIfNotExists(at.scope.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists([]byte(at.name))
+}
+
+// deleteScope deletes the attributes scoped to the given file, run or transfer within the transaction.
+func (at *attributes) deleteScope(tx Tx, scope bucket, name string) error {
+	root := tx.Bucket(scope.Bytes())
+	if root == nil || root.Bucket([]byte(name)) == nil {
+		return nil
+	}
+	return root.DeleteBucket([]byte(name))
+}
+
+// dropScope removes the attributes scoped to the given file, run or transfer from memory.
+func (at *attributes) dropScope(scope bucket, name string) {
+	at.scopes.Delete(scopeKey{scope: scope, name: name})
+}
+
 // loadAll loads the additional data from the database into
-// the TransferManager's additionalData map.
-func (at *attributes) loadAll(tx *bolt.Tx) error {
+// the TransferManager's additionalData map, along with the attributes of every scope.
+func (at *attributes) loadAll(tx Tx) error {
 	b := tx.Bucket(additionalDataBucket.Bytes())
 	if b == nil {
 		return ErrAttBucketNotFound
 	}
 
-	return b.ForEach(func(k, v []byte) error {
-		var data any
-		rdr := bytes.NewReader(v)
-		dec := gob.NewDecoder(rdr)
-		if err := dec.Decode(&data); err != nil {
+	if err := at.load(b, additionalDataBucket); err != nil {
+		return err
+	}
+
+	for _, scope := range []bucket{fileAttributesBucket, runAttributesBucket, transferAttributesBucket} {
+		root := tx.Bucket(scope.Bytes())
+		if root == nil {
+			continue
+		}
+
+		var names []string
+		err := root.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+		if err != nil {
 			return err
 		}
-		at.m.Store(string(k), data)
+
+		for _, name := range names {
+			if err := at.scoped(scope, name).load(root.Bucket([]byte(name)), scope); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load loads the attributes of the given bucket, belonging to the given top level bucket.
+func (at *attributes) load(b Bucket, root bucket) error {
+	// The stale records are written again like in loadRecords
+	rewrite := make(map[string]attribute)
+	err := b.ForEach(func(k, v []byte) error {
+		codec, version, payload, err := at.serializer.migrate(root, k, v)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode attribute '%s'", k)
+		}
+
+		// The older records hold the bare value, its type is unknown.
+		// The payload is only valid during the transaction, it is copied.
+		var attr attribute
+		if version >= attrSchemaVersion {
+			if err := codec.Unmarshal(payload, &attr); err != nil {
+				return errors.Wrapf(err, "failed to decode attribute '%s'", k)
+			}
+		} else {
+			attr = attribute{Codec: codec.ID(), Payload: append([]byte{}, payload...)}
+		}
+
+		if at.serializer.stale(v, codec, version) {
+			rewrite[string(k)] = attr
+		}
+		at.m.Store(string(k), &attrEntry{attribute: attr})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	for key, attr := range rewrite {
+		if err := at.put(b, key, attr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put encodes the attribute record and stores it in the bucket.
+func (at *attributes) put(b Bucket, key string, attr attribute) error {
+	record, err := at.serializer.encode(attr)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), record)
 }
 
-// syncAttribute returns the file metadata for the given source path.
+// syncAttribute writes the attribute of the given key to the database.
 func (at *attributes) syncAttribute(key string) error {
-	att, ok := at.m.Load(key)
+	entry, ok := at.m.Load(key)
 	if !ok {
 		return errors.Errorf("'%s' file key not found in map", key)
 	}
-	return at.StoreOrUpdate(key, att)
+	return at.db.Update(func(tx Tx) error {
+		b, err := at.bucket(tx, true)
+		if err != nil {
+			return err
+		}
+		return at.put(b, key, entry.(*attrEntry).attribute)
+	})
 }
 
 // sync synchronizes the additional data in the database with the additional data in the TransferManager's additionalData map.
+// The global attributes also synchronize the attributes of every scope.
+// The first error is returned.
 func (at *attributes) sync() error {
+	var errGeneral error
 	at.m.Range(func(key, value any) bool {
-		err := at.syncAttribute(key.(string))
-		if err != nil {
-			return false
-		}
-		return true
+		errGeneral = at.syncAttribute(key.(string))
+		return errGeneral == nil
 	})
+	if errGeneral != nil {
+		return errGeneral
+	}
+	if at.scope == "" {
+		at.scopes.Range(func(key, scoped any) bool {
+			errGeneral = scoped.(*attributes).sync()
+			return errGeneral == nil
+		})
+		if errGeneral != nil {
+			return errGeneral
+		}
+	}
 	return at.db.Sync()
 }
 
-// GetSlice returns a slice of additional data
+// value returns the value of the attribute, decoded as the type recorded for it.
+// It returns false if the type is neither a basic type nor a type stored or requested in this process.
+func (at *attributes) value(entry *attrEntry) (any, bool) {
+	if entry.value != nil {
+		return entry.value, true
+	}
+
+	t, ok := attrTypes.Load(entry.Type)
+	if !ok {
+		return nil, false
+	}
+	target := reflect.New(t.(reflect.Type))
+	if err := at.decode(entry.attribute, target.Interface()); err != nil {
+		return nil, false
+	}
+	return target.Elem().Interface(), true
+}
+
+// decode decodes the payload of the attribute into target.
+func (at *attributes) decode(attr attribute, target any) error {
+	codec, ok := at.serializer.codecs[attr.Codec]
+	if !ok {
+		return errors.Wrapf(ErrUnknownCodec, "id %d", attr.Codec)
+	}
+	return codec.Unmarshal(attr.Payload, target)
+}
+
+// GetSlice returns a slice of additional data.
+// The attributes whose type is unknown to Load are left out.
 func (at *attributes) GetSlice() ([]any, error) {
 	var data []any
-	at.m.Range(func(key, value any) bool {
-		data = append(data, value)
+	at.m.Range(func(key, entry any) bool {
+		if value, ok := at.value(entry.(*attrEntry)); ok {
+			data = append(data, value)
+		}
 		return true
 	})
 	return data, nil
 }
 
 // StoreOrUpdate stores or updates the additional data in the database.
-// It encodes the additional data and stores it in the Lock File (BoltDB database).
+// It encodes the additional data and stores it in the Lock File (BoltDB database), along with its dynamic type.
 func (at *attributes) StoreOrUpdate(key string, data any) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(data); err != nil {
-		return err
+	if data == nil {
+		return errors.Errorf("attribute '%s': nil value cannot be stored", key)
 	}
+	return at.set(key, reflect.TypeOf(data), data)
+}
 
-	err := at.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(additionalDataBucket.Bytes())
-		if b == nil {
-			return ErrAttBucketNotFound
+// set stores the value of the given type for the given key.
+func (at *attributes) set(key string, t reflect.Type, data any) error {
+	payload, err := at.serializer.codec.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode attribute '%s'", key)
+	}
+	attr := attribute{Type: registerAttrType(t), Codec: at.serializer.codec.ID(), Payload: payload}
+
+	err = at.db.Update(func(tx Tx) error {
+		b, err := at.bucket(tx, true)
+		if err != nil {
+			return err
 		}
-		return b.Put([]byte(key), buf.Bytes())
+		return at.put(b, key, attr)
 	})
 
 	if err != nil {
 		return err
 	}
 
-	at.m.Store(key, data)
+	at.m.Store(key, &attrEntry{attribute: attr, value: data})
 
 	return nil
 }
 
+// get decodes the value of the given key into target, a pointer to a value of the given type.
+func (at *attributes) get(key string, t reflect.Type, target any) (bool, error) {
+	v, ok := at.m.Load(key)
+	if !ok {
+		return false, nil
+	}
+	entry := v.(*attrEntry)
+
+	name := registerAttrType(t)
+	if entry.Type != "" && entry.Type != name {
+		return true, &AttrTypeError{Key: key, Stored: entry.Type, Requested: name}
+	}
+
+	if entry.value != nil && reflect.TypeOf(entry.value) == t {
+		reflect.ValueOf(target).Elem().Set(reflect.ValueOf(entry.value))
+		return true, nil
+	}
+
+	if err := at.decode(entry.attribute, target); err != nil {
+		return true, errors.Wrapf(err, "failed to decode attribute '%s' as %s", key, name)
+	}
+	return true, nil
+}
+
 // Load returns the additional data for the given key.
+// After a restart, the value can only be decoded if its type is a basic type or a type stored or requested
+// in this process, otherwise it is returned as a RawAttr; GetAttr decodes any type.
 func (at *attributes) Load(key string) (any, bool) {
-	return at.m.Load(key)
+	v, ok := at.m.Load(key)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(*attrEntry)
+	if value, ok := at.value(entry); ok {
+		return value, true
+	}
+	return RawAttr{Type: entry.Type, Codec: entry.Codec, Payload: append([]byte{}, entry.Payload...)}, true
 }
 
 // Delete deletes the additional data for the given key.
 func (at *attributes) Delete(key string) error {
-	err := at.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(additionalDataBucket.Bytes())
-		if b == nil {
-			return ErrAttBucketNotFound
+	err := at.db.Update(func(tx Tx) error {
+		b, err := at.bucket(tx, false)
+		if b == nil || err != nil {
+			return err
 		}
 		return b.Delete([]byte(key))
 	})
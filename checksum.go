@@ -0,0 +1,179 @@
+package reflux
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	AlgorithmMD5    = "md5"
+	AlgorithmSHA1   = "sha1"
+	AlgorithmSHA256 = "sha256"
+	AlgorithmSHA512 = "sha512"
+
+	algorithmSize    = "size"          // Reported by IntegrityError when the byte counts do not match
+	defaultAlgorithm = AlgorithmSHA256 // The algorithm used by Verify when no checksum was recorded
+)
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported checksum algorithm")
+
+// algorithms holds the constructors of the supported hash algorithms.
+var algorithms = map[string]func() hash.Hash{
+	AlgorithmMD5:    md5.New,
+	AlgorithmSHA1:   sha1.New,
+	AlgorithmSHA256: sha256.New,
+	AlgorithmSHA512: sha512.New,
+}
+
+// Checksum is the content hash of a file.
+type Checksum struct {
+	Algorithm string // The hash algorithm, one of the Algorithm constants
+	Digest    string // The hex encoded digest
+}
+
+// IsZero returns whether the checksum is not set.
+func (c Checksum) IsZero() bool {
+	return c.Algorithm == "" && c.Digest == ""
+}
+
+// IntegrityError is returned when a transferred file does not match its source.
+type IntegrityError struct {
+	SourcePath string // The path of the file on the local machine
+	Algorithm  string // The hash algorithm, or "size" when the byte counts do not match
+	Expected   string // The value computed for the source
+	Actual     string // The value found for the target
+}
+
+// Error returns the description of the mismatch.
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for '%s': %s mismatch, expected %s, got %s", e.SourcePath, e.Algorithm, e.Expected, e.Actual)
+}
+
+// Verifier returns the hex encoded digest of the file at targetPath computed with the given algorithm.
+type Verifier func(targetPath string, algorithm string) (string, error)
+
+// ComputeChecksum returns the checksum of the file at path computed with the given algorithm.
+func ComputeChecksum(path string, algorithm string) (Checksum, error) {
+	newHash, ok := algorithms[algorithm]
+	if !ok {
+		return Checksum{}, errors.Wrap(ErrUnsupportedAlgorithm, algorithm)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Checksum{}, err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return Checksum{}, err
+	}
+
+	return Checksum{Algorithm: algorithm, Digest: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Verify checks the integrity of the transfer of the file at sourcePath.
+// The size, when recorded, is compared with the bytes transferred. The checksum of the source is
+// recomputed, with the recorded algorithm or SHA-256, compared with the recorded checksum if any, and
+// with the digest of the target returned by verifier. The computed checksum is stored in the metadata.
+// On a mismatch the file is marked as failed and an *IntegrityError is returned.
+// Only a file in progress or completed can be verified, otherwise an error matching ErrInvalidTransition is returned.
+func (fmm *fileMetadataMap) Verify(sourcePath string, verifier Verifier) error {
+	meta, ok := fmm.Load(sourcePath)
+	if !ok {
+		return errors.Errorf("'%s' file key not found in map", sourcePath)
+	}
+	if !meta.Status.CanTransition(StatusFailed) {
+		return errors.Wrapf(ErrInvalidTransition, "'%s' cannot be verified while %s", sourcePath, meta.Status)
+	}
+
+	if meta.Size > 0 && int64(meta.BytesTransferred) != meta.Size {
+		return fmm.integrityFailure(meta, &IntegrityError{
+			SourcePath: sourcePath,
+			Algorithm:  algorithmSize,
+			Expected:   strconv.FormatInt(meta.Size, 10),
+			Actual:     strconv.Itoa(meta.BytesTransferred),
+		})
+	}
+
+	algorithm := meta.Checksum.Algorithm
+	if algorithm == "" {
+		algorithm = defaultAlgorithm
+	}
+
+	local, err := ComputeChecksum(meta.SourcePath, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if meta.Checksum.Digest != "" && meta.Checksum.Digest != local.Digest {
+		return fmm.integrityFailure(meta, &IntegrityError{
+			SourcePath: sourcePath,
+			Algorithm:  algorithm,
+			Expected:   meta.Checksum.Digest,
+			Actual:     local.Digest,
+		})
+	}
+
+	if err := fmm.setChecksum(sourcePath, local); err != nil {
+		return err
+	}
+
+	remote, err := verifier(meta.TargetPath, algorithm)
+	if err != nil {
+		return err
+	}
+
+	if remote != local.Digest {
+		return fmm.integrityFailure(meta, &IntegrityError{
+			SourcePath: sourcePath,
+			Algorithm:  algorithm,
+			Expected:   local.Digest,
+			Actual:     remote,
+		})
+	}
+
+	return nil
+}
+
+// integrityFailure marks the file as failed with the given integrity error and returns it.
+func (fmm *fileMetadataMap) integrityFailure(meta FileMetadata, errIntegrity *IntegrityError) error {
+	if err := fmm.UpdateStatus(meta.SourcePath, StatusFailed, meta.BytesTransferred, errIntegrity); err != nil {
+		return err
+	}
+	return errIntegrity
+}
+
+// setChecksum stores the checksum in the file metadata for the given source path.
+func (fmm *fileMetadataMap) setChecksum(sourcePath string, checksum Checksum) error {
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
+	meta, ok := fmm.Load(sourcePath)
+	if !ok {
+		return errors.Errorf("'%s' file key not found in map", sourcePath)
+	}
+	meta.Checksum = checksum
+	return fmm.StoreOrUpdate(meta)
+}
+
+// LocalVerifier returns a Verifier that computes the digest of a target on the local filesystem.
+func LocalVerifier() Verifier {
+	return func(targetPath string, algorithm string) (string, error) {
+		checksum, err := ComputeChecksum(targetPath, algorithm)
+		if err != nil {
+			return "", err
+		}
+		return checksum.Digest, nil
+	}
+}
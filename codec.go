@@ -0,0 +1,268 @@
+package reflux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SchemaVersion is the version of the layout of the records written by this package.
+	// Legacy records, written without an envelope, are version 0. Version 2 records the type of the attributes.
+	SchemaVersion uint16 = 2
+
+	CodecGob    byte = 1 // The ID of the gob codec
+	CodecJSON   byte = 2 // The ID of the JSON codec
+	CodecBinary byte = 3 // The ID of the compact binary codec
+
+	envelopeSize = 6 // The size of the envelope header: marker, format ID, codec ID and schema version
+)
+
+// envelopeFormat marks a versioned record. It starts with a zero byte, which never starts a gob stream,
+// so the records written before the envelope was introduced are told apart.
+var envelopeFormat = [3]byte{0, 'R', 'F'}
+
+var (
+	ErrUnknownCodec       = errors.New("unknown codec")
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+// Codec encodes and decodes the records stored in the buckets.
+type Codec interface {
+	// ID returns the identifier of the codec written in the envelope of the records, it must be unique.
+	ID() byte
+
+	// Marshal returns the encoding of v.
+	Marshal(v any) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v any) error
+}
+
+// Migration upgrades the payload of a record of the given bucket from the given schema version to SchemaVersion.
+// The payload is encoded with codec and the returned payload must be encoded with the same codec.
+// A migration that does not apply to the record returns the payload unchanged.
+type Migration func(bucket string, key []byte, version uint16, payload []byte, codec Codec) ([]byte, error)
+
+// GobCodec returns the codec based on encoding/gob. It is also used to read the legacy records.
+func GobCodec() Codec {
+	return gobCodec{}
+}
+
+// JSONCodec returns the codec based on encoding/json, readable outside Go.
+func JSONCodec() Codec {
+	return jsonCodec{}
+}
+
+// BinaryCodec returns the compact binary codec. Struct fields are encoded in order, so the fields of
+// the records can only be appended: a field missing from a record is left zero, an extra one is skipped.
+// Interface values cannot be encoded.
+func BinaryCodec() Codec {
+	return binaryCodec{}
+}
+
+type gobCodec struct{}
+
+// ID returns CodecGob.
+func (gobCodec) ID() byte {
+	return CodecGob
+}
+
+// Marshal returns the gob encoding of v.
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the gob encoded data into v.
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+// ID returns CodecJSON.
+func (jsonCodec) ID() byte {
+	return CodecJSON
+}
+
+// Marshal returns the JSON encoding of v.
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON encoded data into v.
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// serializer wraps the records in a versioned envelope and upgrades the old ones.
+// With a sealer, the enveloped records are encrypted.
+type serializer struct {
+	codec      Codec          // The codec used to write the records
+	codecs     map[byte]Codec // The codecs used to read the records, by ID
+	migrations []Migration    // The migrations applied to the records older than SchemaVersion
+	sealer     *sealer        // Encrypts the records, nil to write them in plain
+}
+
+// newSerializer returns a serializer writing with codec and reading the built-in codecs and codec.
+// The records are encrypted if sealer is not nil.
+func newSerializer(codec Codec, migrations []Migration, sealer *sealer) *serializer {
+	s := &serializer{
+		codec:      codec,
+		codecs:     make(map[byte]Codec),
+		migrations: migrations,
+		sealer:     sealer,
+	}
+	for _, c := range []Codec{GobCodec(), JSONCodec(), BinaryCodec(), codec} {
+		s.codecs[c.ID()] = c
+	}
+	return s
+}
+
+// defaultSerializer reads and writes the records that are independent of the options, such as the lock holder.
+var defaultSerializer = newSerializer(GobCodec(), nil, nil)
+
+// encode returns the record of v wrapped in the envelope.
+func (s *serializer) encode(v any) ([]byte, error) {
+	payload, err := s.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, envelopeSize, envelopeSize+len(payload))
+	copy(record, envelopeFormat[:])
+	record[3] = s.codec.ID()
+	binary.BigEndian.PutUint16(record[4:], SchemaVersion)
+	record = append(record, payload...)
+
+	if s.sealer == nil {
+		return record, nil
+	}
+	return s.sealer.seal(record)
+}
+
+// open returns the codec, the schema version and the payload of a record, decrypting it if needed.
+// A record without an envelope is a legacy gob record of version 0.
+func (s *serializer) open(record []byte) (Codec, uint16, []byte, error) {
+	if sealed(record) {
+		if s.sealer == nil {
+			return nil, 0, nil, ErrEncrypted
+		}
+		var err error
+		if record, err = s.sealer.unseal(record); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	if len(record) < envelopeSize || !bytes.Equal(record[:len(envelopeFormat)], envelopeFormat[:]) {
+		return GobCodec(), 0, record, nil
+	}
+
+	codec, ok := s.codecs[record[3]]
+	if !ok {
+		return nil, 0, nil, errors.Wrapf(ErrUnknownCodec, "id %d", record[3])
+	}
+
+	version := binary.BigEndian.Uint16(record[4:envelopeSize])
+	if version > SchemaVersion {
+		return nil, 0, nil, errors.Wrapf(ErrUnsupportedVersion, "version %d, supported up to %d", version, SchemaVersion)
+	}
+
+	return codec, version, record[envelopeSize:], nil
+}
+
+// decode decodes a record into v, without applying the migrations.
+func (s *serializer) decode(record []byte, v any) error {
+	codec, _, payload, err := s.open(record)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(payload, v)
+}
+
+// load decodes a record of the given bucket into v, applying the migrations if it is older than SchemaVersion.
+// It returns whether the record should be written again, because it is old or written with another codec.
+// The records are written again when the lock file is loaded, so the migrations run once per record and a
+// change of codec or of encryption key applies to the whole lock file, see loadRecords.
+func (s *serializer) load(bucket bucket, key []byte, record []byte, v any) (bool, error) {
+	codec, version, payload, err := s.migrate(bucket, key, record)
+	if err != nil {
+		return false, err
+	}
+
+	if err := codec.Unmarshal(payload, v); err != nil {
+		return false, err
+	}
+
+	return s.stale(record, codec, version), nil
+}
+
+// loadRecords decodes the records of the bucket b, belonging to the given top level bucket, with load and
+// hands them to fn. The stale records are written again once read.
+func loadRecords[T any](s *serializer, b Bucket, root bucket, fn func(key []byte, v T) error) error {
+	rewrite := make(map[string]T)
+	err := b.ForEach(func(k, v []byte) error {
+		// The nested buckets have no value
+		if v == nil {
+			return nil
+		}
+
+		var value T
+		stale, err := s.load(root, k, v, &value)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode '%s' in bucket '%s'", k, root)
+		}
+		if stale {
+			rewrite[string(k)] = value
+		}
+		return fn(k, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, value := range rewrite {
+		record, err := s.encode(value)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(k), record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate returns the codec, the schema version and the payload of a record of the given bucket,
+// once the migrations have been applied to it if it is older than SchemaVersion.
+func (s *serializer) migrate(bucket bucket, key []byte, record []byte) (Codec, uint16, []byte, error) {
+	codec, version, payload, err := s.open(record)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if version < SchemaVersion {
+		for _, migrate := range s.migrations {
+			if payload, err = migrate(string(bucket), key, version, payload, codec); err != nil {
+				return nil, 0, nil, errors.Wrapf(err, "failed to migrate '%s' in bucket '%s'", key, bucket)
+			}
+		}
+	}
+
+	return codec, version, payload, nil
+}
+
+// stale returns whether a record read with the given codec and schema version should be written again,
+// because it is old, written with another codec, or not encrypted with the current key.
+func (s *serializer) stale(record []byte, codec Codec, version uint16) bool {
+	if s.sealer != nil && !s.sealer.sealedWithCurrent(record) {
+		return true
+	}
+	return version < SchemaVersion || codec.ID() != s.codec.ID()
+}
@@ -0,0 +1,320 @@
+package reflux
+
+import (
+	"encoding"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+)
+
+var (
+	ErrUnsupportedType = errors.New("type not supported by the binary codec")
+	ErrCorruptRecord   = errors.New("corrupt binary record")
+)
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+type binaryCodec struct{}
+
+// ID returns CodecBinary.
+func (binaryCodec) ID() byte {
+	return CodecBinary
+}
+
+// Marshal returns the compact binary encoding of v.
+func (binaryCodec) Marshal(v any) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(v))
+}
+
+// Unmarshal decodes the compact binary encoded data into the value pointed to by v.
+func (binaryCodec) Unmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.Wrap(ErrUnsupportedType, "decoding requires a non-nil pointer")
+	}
+
+	rest, err := readBinary(data, rv.Elem())
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.Wrap(ErrCorruptRecord, "trailing bytes")
+	}
+	return nil
+}
+
+// appendBytes appends the length of b followed by b.
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// appendBinary appends the encoding of v to buf.
+// A struct is encoded as its number of exported fields followed by each field prefixed by its length,
+// so a decoder knowing fewer fields can skip the extra ones.
+func appendBinary(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return nil, errors.Wrap(ErrUnsupportedType, "nil value")
+	}
+
+	if v.Type().Implements(binaryMarshalerType) && v.Kind() != reflect.Pointer {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(buf, b), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendBytes(buf, []byte(v.String())), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(buf, v.Bytes()), nil
+		}
+		fallthrough
+	case reflect.Array:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = appendBinary(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			var err error
+			if buf, err = appendBinary(buf, iter.Key()); err != nil {
+				return nil, err
+			}
+			if buf, err = appendBinary(buf, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(buf, 0), nil
+		}
+		return appendBinary(append(buf, 1), v.Elem())
+	case reflect.Struct:
+		fields := exportedFields(v.Type())
+		buf = binary.AppendUvarint(buf, uint64(len(fields)))
+		for _, i := range fields {
+			field, err := appendBinary(nil, v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			buf = appendBytes(buf, field)
+		}
+		return buf, nil
+	}
+
+	return nil, errors.Wrap(ErrUnsupportedType, v.Type().String())
+}
+
+// exportedFields returns the indexes of the exported fields of a struct type.
+func exportedFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// readUvarint reads an unsigned varint from data.
+func readUvarint(data []byte) (uint64, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 {
+		return 0, nil, ErrCorruptRecord
+	}
+	return n, data[size:], nil
+}
+
+// readBytes reads a length prefixed byte slice from data.
+func readBytes(data []byte) ([]byte, []byte, error) {
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(data)) < n {
+		return nil, nil, ErrCorruptRecord
+	}
+	return data[:n], data[n:], nil
+}
+
+// readBinary decodes data into v and returns the remaining bytes.
+// Empty slices and maps are decoded as nil, like encoding/gob does.
+func readBinary(data []byte, v reflect.Value) ([]byte, error) {
+	if v.Kind() != reflect.Pointer && reflect.PointerTo(v.Type()).Implements(binaryUnmarshalerType) {
+		b, rest, err := readBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		return rest, v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if len(data) < 1 {
+			return nil, ErrCorruptRecord
+		}
+		v.SetBool(data[0] != 0)
+		return data[1:], nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, size := binary.Varint(data)
+		if size <= 0 {
+			return nil, ErrCorruptRecord
+		}
+		v.SetInt(n)
+		return data[size:], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		v.SetUint(n)
+		return rest, nil
+	case reflect.Float32, reflect.Float64:
+		if len(data) < 8 {
+			return nil, ErrCorruptRecord
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		return data[8:], nil
+	case reflect.String:
+		b, rest, err := readBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		v.SetString(string(b))
+		return rest, nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, rest, err := readBytes(data)
+			if err != nil {
+				return nil, err
+			}
+			v.SetBytes(nil)
+			if len(b) != 0 {
+				v.SetBytes(append([]byte{}, b...))
+			}
+			return rest, nil
+		}
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, ErrCorruptRecord
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return rest, nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), int(n), int(n)))
+		for i := 0; i < int(n); i++ {
+			if rest, err = readBinary(rest, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	case reflect.Array:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n != uint64(v.Len()) {
+			return nil, ErrCorruptRecord
+		}
+		for i := 0; i < v.Len(); i++ {
+			if rest, err = readBinary(rest, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return rest, nil
+	case reflect.Map:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, ErrCorruptRecord
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return rest, nil
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), int(n)))
+		for i := 0; i < int(n); i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if rest, err = readBinary(rest, key); err != nil {
+				return nil, err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if rest, err = readBinary(rest, value); err != nil {
+				return nil, err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return rest, nil
+	case reflect.Pointer:
+		if len(data) < 1 {
+			return nil, ErrCorruptRecord
+		}
+		if data[0] == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return data[1:], nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		rest, err := readBinary(data[1:], elem.Elem())
+		if err != nil {
+			return nil, err
+		}
+		v.Set(elem)
+		return rest, nil
+	case reflect.Struct:
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		fields := exportedFields(v.Type())
+		for i := 0; i < int(n); i++ {
+			var field []byte
+			if field, rest, err = readBytes(rest); err != nil {
+				return nil, err
+			}
+			if i >= len(fields) {
+				// A field added by a later version of the type.
+				continue
+			}
+			if trailing, err := readBinary(field, v.Field(fields[i])); err != nil {
+				return nil, err
+			} else if len(trailing) != 0 {
+				return nil, ErrCorruptRecord
+			}
+		}
+		return rest, nil
+	}
+
+	return nil, errors.Wrap(ErrUnsupportedType, v.Type().String())
+}
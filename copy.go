@@ -0,0 +1,162 @@
+package reflux
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"time"
+)
+
+// PartialSuffix is appended to the target path to name the file receiving the data until the transfer is complete.
+const PartialSuffix = ".reflux-part"
+
+const (
+	copyBufferSize  = 256 << 10 // The size of the chunks copied between two checks of the context
+	partialFileMode = 0600      // The mode of the partial target, the mode of the source is set once it is complete
+)
+
+var ErrOffsetMismatch = errors.New("offset does not match the partial target")
+
+// CopyFile is a Transfer copying a local file, or a file of a mounted filesystem such as NFS, from the start.
+// The data is written to targetPath with PartialSuffix, synced and renamed to targetPath, so
+// targetPath is either missing or complete. The mode and the modification time of the source are preserved.
+func CopyFile(sourcePath string, targetPath string) (int, error) {
+	return copyFile(context.Background(), sourcePath, targetPath, 0, nil)
+}
+
+// CopyFileFrom is a ResumableTransfer copying a file like CopyFile, appending to the partial target
+// from offset. The partial target must hold at least offset bytes, the bytes past offset were not recorded
+// and are overwritten. It returns the bytes written by the call, also when it fails.
+func CopyFileFrom(sourcePath string, targetPath string, offset int) (int, error) {
+	return copyFile(context.Background(), sourcePath, targetPath, offset, nil)
+}
+
+// CopyFileFromContext is a ResumableContextTransfer copying a file like CopyFileFrom.
+// The copy stops once ctx is cancelled, the partial target is kept.
+func CopyFileFromContext(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+	return copyFile(ctx, sourcePath, targetPath, offset, nil)
+}
+
+// CopyFileProgress is a ProgressTransfer copying a file like CopyFile. The bytes written are reported to
+// progress and the copy stops once ctx is cancelled, the partial target is kept.
+func CopyFileProgress(ctx context.Context, sourcePath string, targetPath string, progress *Progress) (int, error) {
+	return copyFile(ctx, sourcePath, targetPath, 0, progress)
+}
+
+// copyFile copies sourcePath to targetPath from offset and returns the bytes written.
+// The progress is optional.
+func copyFile(ctx context.Context, sourcePath string, targetPath string, offset int, progress *Progress) (int, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || int64(offset) > info.Size() {
+		return 0, errors.Wrapf(ErrOffsetMismatch, "offset %d, source size %d", offset, info.Size())
+	}
+
+	// The previous attempt copied the whole file and was interrupted before the status was recorded
+	if offset > 0 && int64(offset) == info.Size() {
+		if target, err := os.Stat(targetPath); err == nil && target.Size() == info.Size() {
+			return 0, nil
+		}
+	}
+
+	partialPath := targetPath + PartialSuffix
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	partial, err := os.OpenFile(partialPath, flags, partialFileMode)
+	if err != nil {
+		return 0, err
+	}
+	defer partial.Close()
+
+	if offset > 0 {
+		partialInfo, err := partial.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if partialInfo.Size() < int64(offset) {
+			return 0, errors.Wrapf(ErrOffsetMismatch, "offset %d, '%s' holds %d bytes", offset, partialPath, partialInfo.Size())
+		}
+		if err := partial.Truncate(int64(offset)); err != nil {
+			return 0, err
+		}
+		if _, err := partial.Seek(int64(offset), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := source.Seek(int64(offset), io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := CopyChunks(ctx, partial, source, progress)
+	if err != nil {
+		// Keep the bytes written so the copy can be resumed from them
+		_ = partial.Sync()
+		return n, err
+	}
+
+	if err := partial.Chmod(info.Mode().Perm()); err != nil {
+		return n, err
+	}
+	if err := partial.Sync(); err != nil {
+		return n, err
+	}
+	if err := partial.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Chtimes(partialPath, time.Now(), info.ModTime()); err != nil {
+		return n, err
+	}
+	if err := os.Rename(partialPath, targetPath); err != nil {
+		return n, err
+	}
+	return n, syncDir(targetPath)
+}
+
+// CopyChunks copies src to dst until EOF and returns the bytes written, also when it fails.
+// The context is checked between the chunks and the bytes written are reported to progress, which is optional.
+// A write of fewer bytes than the chunk without an error fails with io.ErrShortWrite, like io.Copy.
+// The transfer modules write their targets with it.
+func CopyChunks(ctx context.Context, dst io.Writer, src io.Reader, progress *Progress) (int, error) {
+	buf := make([]byte, copyBufferSize)
+	written := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		nr, errRead := src.Read(buf)
+		if nr > 0 {
+			nw, err := dst.Write(buf[:nr])
+			written += nw
+			if err == nil && nw < nr {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return written, err
+			}
+			if progress != nil {
+				if err := progress.Add(nw); err != nil {
+					return written, err
+				}
+			}
+		}
+
+		if errRead == io.EOF {
+			return written, nil
+		}
+		if errRead != nil {
+			return written, errRead
+		}
+	}
+}
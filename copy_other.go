@@ -0,0 +1,8 @@
+//go:build !unix
+
+package reflux
+
+// syncDir does nothing, the directories cannot be synced on this platform.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package reflux
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncDir syncs the directory of the file, so its creation or renaming survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -2,6 +2,8 @@
 //
 // The TransferManager handles file transfers, tracks transfer status, and stores additional data associated with files.
 // It uses BoltDB as the underlying database to store file metadata, server information, and additional data.
+// Another storage backend, such as the in-memory store returned by NewMemoryStore or the journal file
+// opened by OpenJournalStore, can be set with WithStore.
 //
 // File Transfers:
 // The TransferManager manages file transfers and tracks the status of each transfer. The status can be one of the following:
@@ -9,12 +11,51 @@
 // - StatusInProgress: The transfer is currently in progress.
 // - StatusCompleted: The transfer has been successfully completed.
 // - StatusFailed: The transfer has failed.
+// - StatusInterrupted: The transfer was interrupted by the cancellation of the manager context.
+//
+// The files of a directory tree are registered with FileMetadataMap.EnqueueTree, filtered by TreeOptions,
+// the files already known keeping their state.
+//
+// CopyFile, CopyFileFrom and CopyFileProgress are transfers copying local files through a partial target
+// renamed once complete, CopyFileFrom resumes the copy from the recorded offset.
 //
 // Additional Data:
 // Developers can use the AttributesMap to store additional data related to files. This can be useful for storing custom information, such as command flags or any other data relevant to the file transfers.
+// SetAttr and GetAttr store and retrieve typed attributes, the type of the value is recorded along with it.
+// The attributes can be scoped to a file or a run with AttributesMap.File and AttributesMap.Run.
 //
 // Server Information:
 // The TransferManager can store server information, including the server address, port, and user. This information can be retrieved using the GetServerInfo method.
+// The server info also references the scheme, the base directory, the auth method, the timeouts and the options
+// needed to reconnect, it converts to and from a URL with ServerInfo.URL and ParseServerURL.
+// Named server profiles are managed with StoreServer, Server, ListServers and DeleteServer, the files
+// transferred to a named server are kept apart by FileMetadataMap.Server. The sftptransfer module uploads the
+// files to the SFTP server of the stored server info, the httptransfer package transfers them over HTTP and the
+// s3transfer package uploads them to an S3 bucket with multipart uploads resumed from the missing parts.
+//
+// Configuration:
+// NewTransferManager accepts functional options, see Option. WithLockFile, WithLockDir, WithFileMode and
+// WithTimeout set the lock file, WithSignalHandling and WithContext the cancellation of the manager context,
+// WithRetryPolicy and WithProgressInterval the transfers. WithResolver checks the hostnames of the servers.
+//
+// Single instance:
+// Only one process holds a lock file. WithStrictLock refuses a lock held on another host, WithLockTakeover
+// takes over a lock whose holder may still be running.
+//
+// Record format:
+// The records are written in a versioned envelope with the codec set by WithCodec, the records of an older
+// schema are upgraded on load by the migrations set with WithMigrations.
+//
+// Encryption at rest:
+// WithEncryption encrypts the records with AES-GCM, RotateKey encrypts them again after a new key was added
+// to the KeyProvider.
+//
+// Detecting source changes:
+// WithChangeDetection resets the files whose source changed since the previous run, WithChecksumDetection
+// also compares their checksums.
+//
+// Transfer history:
+// WithHistoryRetention sets the number of history records kept per file.
 //
 // Usage:
 // 1. Create a new TransferManager instance using the NewTransferManager function.
@@ -72,14 +113,11 @@
 package reflux
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"sync"
 	"syscall"
 )
@@ -94,18 +132,29 @@ const (
 	StatusInProgress
 	StatusCompleted
 	StatusFailed
+	StatusInterrupted
 )
 
 // TransferManager manages file transfers and server information.
 type TransferManager struct {
-	lockFilePath string             // The path of the lock file
-	serverInfo   *ServerInfo        // The server info to reconnect
-	preexisting  bool               // Whether the lock file already existed
-	Files        FileMetadataMap    // type FileMetadata, to avoid race conditions Key is the file path
-	Attributes   AttributesMap      // Developers can use this to store additional data, for example command flags the developer is using to run the command
-	db           *bolt.DB           // The BoltDB database instance.
-	ctx          context.Context    // The context for handling signals and cancellation.
-	cancel       context.CancelFunc // The cancelation function for the context.
+	lockFilePath   string             // The path of the lock file
+	servers        sync.Map           // The server profiles to reconnect, by name
+	preexisting    bool               // Whether the lock file already existed
+	Files          FileMetadataMap    // type FileMetadata, to avoid race conditions Key is the file path
+	Attributes     AttributesMap      // Developers can use this to store additional data, for example command flags the developer is using to run the command
+	db             Store              // The storage backend, the BoltDB lock file by default.
+	ownsStore      bool               // Whether the store is the lock file opened by the manager.
+	ctx            context.Context    // The context for handling signals and cancellation.
+	cancel         context.CancelFunc // The cancelation function for the context.
+	progress       *progressHub       // Publishes the aggregate progress of the transfers.
+	invalidated    []InvalidatedFile  // The files reset because their source changed since the previous run.
+	previousHolder *LockHolder        // The process that held the lock file before and did not release it.
+	holding        bool               // Whether the current process is recorded as the holder of the lock file.
+	runID          string             // The ID of the current run.
+	serializer     *serializer        // Encodes the records in the versioned envelope.
+	resolver       Resolver           // Resolves the hostnames of the stored servers, nil skips the resolution.
+	mu             sync.Mutex         // Protects signal.
+	signal         os.Signal          // The handled signal received, if any.
 }
 
 type bucket string // The name of a bucket
@@ -116,45 +165,78 @@ func (b bucket) Bytes() []byte {
 }
 
 const (
-	filesBucket          = bucket("Files")
-	serverBucket         = bucket("Server")
-	additionalDataBucket = bucket("AdditionalData")
-	serverInfoKey        = "Info"
+	filesBucket              = bucket("Files")
+	serverBucket             = bucket("Server")
+	additionalDataBucket     = bucket("AdditionalData")
+	lockBucket               = bucket("Lock")
+	historyRootBucket        = bucket("History")
+	attemptsRootBucket       = bucket("Attempts")
+	runsBucket               = bucket("Runs")
+	fileAttributesBucket     = bucket("FileAttributes")
+	runAttributesBucket      = bucket("RunAttributes")
+	transferAttributesBucket = bucket("TransferAttributes")
 )
 
 // NewTransferManager creates a new TransferManager instance.
 // It initializes the lock file path, opens the database, and initializes the buckets.
 // If the lock file already exists, it loads the existing data from the database.
-func NewTransferManager() (*TransferManager, error) {
-	tm := &TransferManager{
-		lockFilePath: "./." + filepath.Base(os.Args[0]) + ".lock",
+// By default the lock file is created in the working directory and named after the running binary,
+// the behaviour can be changed with the given options.
+func NewTransferManager(opts ...Option) (*TransferManager, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
 	}
-	// Check if the lock file exists.
-	if _, err := os.Stat(tm.lockFilePath); err == nil {
-		tm.preexisting = true
+
+	var sealer *sealer
+	if o.keys != nil {
+		var err error
+		if sealer, err = newSealer(o.keys); err != nil {
+			return nil, errors.Wrap(err, "failed to load the encryption keys")
+		}
 	}
 
-	// Open the database.
-	db, err := bolt.Open(tm.lockFilePath, 0600, nil)
+	tm := &TransferManager{
+		lockFilePath: o.path(),
+		ownsStore:    o.store == nil,
+		serializer:   newSerializer(o.codec, o.migrations, sealer),
+		resolver:     o.resolver,
+	}
+
+	db, err := tm.openStore(o)
 	if err != nil {
 		return nil, err
 	}
 
-	tm.ctx, tm.cancel = context.WithCancel(context.Background())
+	tm.runID, err = newRunID()
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "failed to generate run ID")
+	}
+
+	tm.ctx, tm.cancel = context.WithCancel(o.ctx)
+	tm.progress = newProgressHub()
+	hostname, _ := os.Hostname()
 
 	tm.db = db
+	tm.Attributes = newAttributes(tm.db, tm.serializer)
 	tm.Files = &fileMetadataMap{
-		db: tm.db,
-		m:  &sync.Map{},
-	}
-
-	tm.Attributes = &attributes{
-		db: tm.db,
-		m:  &sync.Map{},
+		db:               tm.db,
+		m:                &sync.Map{},
+		mu:               &sync.Mutex{},
+		ctx:              tm.ctx,
+		retryPolicy:      o.retryPolicy,
+		progress:         tm.progress,
+		progressInterval: o.progressInterval,
+		historyRetention: o.historyRetention,
+		hostname:         hostname,
+		runID:            tm.runID,
+		serializer:       tm.serializer,
+		attributes:       tm.Attributes,
 	}
 
 	// Initialize buckets
-	err = tm.db.Update(func(tx *bolt.Tx) error {
+	err = tm.db.Update(func(tx Tx) error {
 		_, err := tx.CreateBucketIfNotExists(filesBucket.Bytes())
 		if err != nil {
 			return err
@@ -168,24 +250,95 @@ func NewTransferManager() (*TransferManager, error) {
 	})
 
 	if err != nil {
+		tm.abort()
+		return nil, err
+	}
+
+	// Record the current process as the holder of the lock file.
+	if err := tm.acquireLock(o); err != nil {
+		tm.abort()
+		return nil, err
+	}
+
+	// Record the current run, the previous runs that never ended crashed.
+	if err := tm.startRun(); err != nil {
+		tm.abort()
 		return nil, err
 	}
 
 	// If the lock file already existed, load the existing data.
 	if tm.preexisting {
 		if err := tm.loadExistingData(); err != nil {
+			tm.abort()
 			return nil, err
 		}
+
+		if o.changeDetection {
+			tm.invalidated, err = tm.Files.invalidateChanged(o.checksumDetection)
+			if err != nil {
+				tm.abort()
+				return nil, err
+			}
+		}
 	}
 
-	err = tm.setupSignalHandling()
-	if err != nil {
-		return nil, err
+	if o.signalHandling {
+		err = tm.setupSignalHandling()
+		if err != nil {
+			tm.abort()
+			return nil, err
+		}
 	}
 
 	return tm, nil
 }
 
+// openStore returns the store given with WithStore, or opens the BoltDB lock file.
+// It also determines whether the store holds the data of a previous run.
+func (tm *TransferManager) openStore(o *options) (Store, error) {
+	if o.store != nil {
+		err := o.store.View(func(tx Tx) error {
+			tm.preexisting = tx.Bucket(filesBucket.Bytes()) != nil
+			return nil
+		})
+		return o.store, err
+	}
+
+	// Check if the lock file exists.
+	if _, err := os.Stat(tm.lockFilePath); err == nil {
+		tm.preexisting = true
+	}
+
+	// Open the database.
+	db, err := OpenBoltStore(tm.lockFilePath, o.fileMode, o.timeout)
+	if errors.Is(err, bolt.ErrTimeout) {
+		holder, _ := readLockHolder(tm.lockFilePath)
+		return nil, &LockedError{Path: tm.lockFilePath, Holder: holder}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open lock file")
+	}
+	return db, nil
+}
+
+// abort releases the resources held by a TransferManager that failed to initialize.
+// The holder is removed once it was recorded, the lock file is left on disk.
+func (tm *TransferManager) abort() {
+	tm.cancel()
+	if tm.holding {
+		_ = tm.releaseLock()
+	}
+	if tm.ownsStore {
+		_ = tm.db.Close()
+	}
+}
+
+// Context returns the context of the TransferManager.
+// It is cancelled when the parent context is cancelled, when a handled signal is received or when the manager is closed.
+func (tm *TransferManager) Context() context.Context {
+	return tm.ctx
+}
+
 // IsPreexisting returns whether the lock file already existed.
 // this is useful to get the latest run status and resume the transfer.
 func (tm *TransferManager) IsPreexisting() bool {
@@ -193,10 +346,14 @@ func (tm *TransferManager) IsPreexisting() bool {
 }
 
 // loadExistingData loads the existing data from the database.
-// It loads the file metadata, server info, and additional data.
+// It loads the file metadata, server info, and additional data, and migrates the history.
+// The runs are migrated by startRun.
+// The records older than SchemaVersion go through the migrations, they are written again in the
+// current schema with the configured codec, as are the records written with another codec.
+// With encryption, the records not encrypted with the current key are encrypted.
 // After loading the data, it performs a database sync to ensure data integrity.
 func (tm *TransferManager) loadExistingData() error {
-	return tm.db.View(func(tx *bolt.Tx) error {
+	err := tm.db.Update(func(tx Tx) error {
 		if err := tm.Files.loadAll(tx); err != nil {
 			return err
 		}
@@ -205,46 +362,63 @@ func (tm *TransferManager) loadExistingData() error {
 			return err
 		}
 
-		if err := tm.loadServerInfo(tx); err != nil {
+		if err := tm.loadServers(tx); err != nil {
 			return err
 		}
 
-		return tm.db.Sync()
+		return tm.loadHistory(tx)
 	})
-}
-
-// loadServerInfo loads the server info from the database into the TransferManager's serverInfo field.
-func (tm *TransferManager) loadServerInfo(tx *bolt.Tx) error {
-	b := tx.Bucket(serverBucket.Bytes())
-	if b == nil {
-		return nil
-	}
-
-	v := b.Get([]byte(serverInfoKey))
-	if v == nil {
-		return nil
+	if err != nil {
+		return err
 	}
 
-	return gob.NewDecoder(bytes.NewReader(v)).Decode(&tm.serverInfo)
+	return tm.db.Sync()
 }
 
 // Close closes the TransferManager and performs cleanup operations.
-// It syncs the database, closes the database connection, and removes the lock file.
+// It records the end of the run, releases the lock, syncs the database and closes the database connection.
+// A store given with WithStore is synced but not closed, it belongs to the caller.
 func (tm *TransferManager) Close() error {
+	return tm.close(ExitClose)
+}
+
+// close closes the TransferManager, recording the given exit reason of the run.
+func (tm *TransferManager) close(reason ExitReason) error {
+	defer tm.cancel()
+	defer tm.progress.close()
+
+	if err := tm.stopRun(reason); err != nil {
+		return errors.Wrap(err, "failed to record the end of the run")
+	}
+
+	if err := tm.releaseLock(); err != nil {
+		return errors.Wrap(err, "failed to release lock file")
+	}
+
 	if err := tm.db.Sync(); err != nil {
 		return errors.Wrap(err, "failed to sync database")
 	}
 
+	if !tm.ownsStore {
+		return nil
+	}
+
 	if err := tm.db.Close(); err != nil {
 		return errors.Wrap(err, "failed to close database")
 	}
 	return nil
 }
 
+// Finish closes the TransferManager and removes the lock file.
+// The content of a store given with WithStore is kept.
+// It should be called once all the transfers have been completed.
 func (tm *TransferManager) Finish() error {
-	if err := tm.Close(); err != nil {
+	if err := tm.close(ExitFinish); err != nil {
 		return err
 	}
+	if !tm.ownsStore {
+		return nil
+	}
 	if err := os.Remove(tm.lockFilePath); err != nil {
 		return errors.Wrap(err, "failed to remove lock file")
 	}
@@ -257,9 +431,13 @@ func (tm *TransferManager) setupSignalHandling() error {
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
+		defer signal.Stop(sigCh)
 		select {
-		case <-sigCh:
+		case sig := <-sigCh:
 			// Received OS signal, initiate shutdown
+			tm.mu.Lock()
+			tm.signal = sig
+			tm.mu.Unlock()
 			tm.cancel()
 		case <-tm.ctx.Done():
 			// Context canceled, exit goroutine
@@ -0,0 +1,249 @@
+package reflux
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+)
+
+const (
+	keyIDSize     = 8                                        // The size of the ID of a key, a prefix of its SHA-256 hash
+	nonceSize     = 12                                       // The size of the GCM nonce
+	sealedHeader  = len(sealedFormat) + keyIDSize            // The size of the header of a sealed record, authenticated with it
+	sealedMinSize = sealedHeader + nonceSize + aes.BlockSize // The size of a sealed empty record: header, nonce and tag
+)
+
+// sealedFormat marks a record encrypted at rest. Like envelopeFormat it starts with a zero byte.
+var sealedFormat = [3]byte{0, 'R', 'E'}
+
+var (
+	ErrEncrypted  = errors.New("record is encrypted and no key provider is set")
+	ErrWrongKey   = errors.New("record cannot be decrypted with the given keys")
+	ErrInvalidKey = errors.New("invalid encryption key")
+)
+
+// KeyProvider supplies the AES keys encrypting the records at rest, of 16, 24 or 32 bytes.
+// The first key encrypts the records, all the keys decrypt them: to rotate the key, put the new key first
+// and keep the old one until RotateKey has been called.
+type KeyProvider interface {
+	// Keys returns the encryption keys, the current one first.
+	Keys() ([][]byte, error)
+}
+
+// KeyFunc is a KeyProvider calling the function, to fetch the keys from a secret manager.
+type KeyFunc func() ([][]byte, error)
+
+// Keys returns the keys returned by the function.
+func (f KeyFunc) Keys() ([][]byte, error) {
+	return f()
+}
+
+// EnvKeys returns a KeyProvider reading the base64 encoded keys from the given environment variables,
+// the current one first. The variables of the older keys may be unset.
+func EnvKeys(names ...string) KeyProvider {
+	return KeyFunc(func() ([][]byte, error) {
+		return readKeys(names, func(name string) (string, bool, error) {
+			value, ok := os.LookupEnv(name)
+			return value, ok, nil
+		})
+	})
+}
+
+// FileKeys returns a KeyProvider reading the base64 encoded keys from the given files, the current one first.
+// The files of the older keys may be missing.
+func FileKeys(paths ...string) KeyProvider {
+	return KeyFunc(func() ([][]byte, error) {
+		return readKeys(paths, func(path string) (string, bool, error) {
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				return "", false, nil
+			}
+			return string(data), err == nil, err
+		})
+	})
+}
+
+// readKeys decodes the base64 keys read from the given sources. Only the first source is required.
+func readKeys(sources []string, read func(source string) (string, bool, error)) ([][]byte, error) {
+	var keys [][]byte
+	for i, source := range sources {
+		value, ok, err := read(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read key '%s'", source)
+		}
+		if !ok {
+			if i == 0 {
+				return nil, errors.Wrapf(ErrInvalidKey, "'%s' not set", source)
+			}
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidKey, "'%s' is not base64: %s", source, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sealer encrypts and decrypts the records with AES-GCM.
+// A sealed record is made of sealedFormat, the ID of the key, the nonce and the encrypted record.
+type sealer struct {
+	current [keyIDSize]byte                 // The ID of the key encrypting the records
+	aeads   map[[keyIDSize]byte]cipher.AEAD // The ciphers of every key, by ID
+}
+
+// newSealer returns a sealer using the keys of the provider.
+func newSealer(provider KeyProvider) (*sealer, error) {
+	keys, err := provider.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrap(ErrInvalidKey, "no key")
+	}
+
+	s := &sealer{aeads: make(map[[keyIDSize]byte]cipher.AEAD)}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidKey, err.Error())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		id := keyID(key)
+		if i == 0 {
+			s.current = id
+		}
+		s.aeads[id] = aead
+	}
+	return s, nil
+}
+
+// keyID returns the ID of a key, recorded in the records it encrypts.
+func keyID(key []byte) [keyIDSize]byte {
+	var id [keyIDSize]byte
+	sum := sha256.Sum256(key)
+	copy(id[:], sum[:])
+	return id
+}
+
+// sealed returns whether the record is encrypted.
+func sealed(record []byte) bool {
+	return len(record) >= sealedMinSize && bytes.Equal(record[:len(sealedFormat)], sealedFormat[:])
+}
+
+// seal encrypts the record with the current key.
+func (s *sealer) seal(record []byte) ([]byte, error) {
+	aead := s.aeads[s.current]
+
+	sealedRecord := make([]byte, sealedHeader+aead.NonceSize(), sealedHeader+aead.NonceSize()+len(record)+aead.Overhead())
+	copy(sealedRecord, sealedFormat[:])
+	copy(sealedRecord[len(sealedFormat):], s.current[:])
+	nonce := sealedRecord[sealedHeader:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealedRecord, nonce, record, sealedRecord[:sealedHeader]), nil
+}
+
+// unseal decrypts a sealed record.
+// It returns ErrWrongKey if the record was encrypted with another key or was altered.
+func (s *sealer) unseal(record []byte) ([]byte, error) {
+	var id [keyIDSize]byte
+	copy(id[:], record[len(sealedFormat):sealedHeader])
+
+	aead, ok := s.aeads[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrWrongKey, "encrypted with key %s", hex.EncodeToString(id[:]))
+	}
+
+	nonce := record[sealedHeader : sealedHeader+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, record[sealedHeader+aead.NonceSize():], record[:sealedHeader])
+	if err != nil {
+		return nil, errors.Wrapf(ErrWrongKey, "key %s: %s", hex.EncodeToString(id[:]), err)
+	}
+	return plain, nil
+}
+
+// sealedWithCurrent returns whether the record is encrypted with the current key.
+func (s *sealer) sealedWithCurrent(record []byte) bool {
+	return sealed(record) && bytes.Equal(record[len(sealedFormat):sealedHeader], s.current[:])
+}
+
+// RotateKey encrypts again every record of the store with the current key of the KeyProvider set with
+// WithEncryption, so the older keys can be removed from the provider. The lock holder is never encrypted,
+// it is read by the other processes.
+func (tm *TransferManager) RotateKey() error {
+	if tm.serializer.sealer == nil {
+		return errors.Wrap(ErrInvalidKey, "no key provider set")
+	}
+
+	return tm.db.Update(func(tx Tx) error {
+		return tm.reseal(tx, filesBucket, serverBucket, additionalDataBucket, historyRootBucket,
+			attemptsRootBucket, runsBucket, fileAttributesBucket, runAttributesBucket, transferAttributesBucket)
+	})
+}
+
+// reseal encrypts with the current key the records of the given buckets.
+func (tm *TransferManager) reseal(tx Tx, buckets ...bucket) error {
+	for _, name := range buckets {
+		if b := tx.Bucket(name.Bytes()); b != nil {
+			if err := tm.serializer.reseal(b); err != nil {
+				return errors.Wrapf(err, "failed to encrypt bucket '%s'", name)
+			}
+		}
+	}
+	return nil
+}
+
+// reseal encrypts with the current key the records of the bucket and of its nested buckets.
+func (s *serializer) reseal(b Bucket) error {
+	records := make(map[string][]byte)
+	var nested []string
+	err := b.ForEach(func(k, v []byte) error {
+		switch {
+		case v == nil:
+			nested = append(nested, string(k))
+		case !s.sealer.sealedWithCurrent(v):
+			records[string(k)] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, record := range records {
+		if sealed(record) {
+			if record, err = s.sealer.unseal(record); err != nil {
+				return errors.Wrapf(err, "record '%s'", k)
+			}
+		}
+		if record, err = s.sealer.seal(record); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(k), record); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range nested {
+		if err := s.reseal(b.Bucket([]byte(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package reflux
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	ReasonMissing  = "missing"  // The source file no longer exists
+	ReasonSize     = "size"     // The size of the source file changed
+	ReasonModTime  = "mtime"    // The modification time of the source file changed
+	ReasonInode    = "inode"    // The source file was replaced by another file
+	ReasonChecksum = "checksum" // The content of the source file changed
+)
+
+// InvalidatedFile describes a file whose source changed between runs. The resume state of a file not completed
+// is discarded, a completed file is kept as it is and only reported: Previous.Status tells them apart.
+type InvalidatedFile struct {
+	Previous FileMetadata // The metadata recorded by the previous run
+	Reason   string       // What changed, one of the Reason constants
+}
+
+// NewFileMetadata returns the metadata of a file that has not been transferred yet,
+// with the fingerprint (size, modification time and inode) of the file at sourcePath.
+func NewFileMetadata(sourcePath string, targetPath string) (FileMetadata, error) {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	return FileMetadata{
+		SourcePath: sourcePath,
+		TargetPath: targetPath,
+		Status:     StatusNotStarted,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Inode:      inode(info),
+	}, nil
+}
+
+// fingerprinted returns whether the metadata holds a fingerprint of the source file.
+func (meta FileMetadata) fingerprinted() bool {
+	return meta.Size > 0 || !meta.ModTime.IsZero() || meta.Inode != 0 || meta.Checksum.Digest != ""
+}
+
+// changed compares the fingerprint recorded in the metadata with the source file on disk, the checksum
+// being computed again only if hash is set. It returns the reason of the first difference found,
+// or an empty string if the file did not change.
+func (meta FileMetadata) changed(info os.FileInfo, hash bool) (string, error) {
+	switch {
+	case meta.Size > 0 && info.Size() != meta.Size:
+		return ReasonSize, nil
+	case !meta.ModTime.IsZero() && !info.ModTime().Equal(meta.ModTime):
+		return ReasonModTime, nil
+	case meta.Inode != 0 && inode(info) != 0 && inode(info) != meta.Inode:
+		return ReasonInode, nil
+	}
+
+	if hash && meta.Checksum.Digest != "" {
+		checksum, err := ComputeChecksum(meta.SourcePath, meta.Checksum.Algorithm)
+		if err != nil {
+			return "", err
+		}
+		if checksum.Digest != meta.Checksum.Digest {
+			return ReasonChecksum, nil
+		}
+	}
+
+	return "", nil
+}
+
+// invalidateChanged resets the files not completed whose source changed since their fingerprint was recorded,
+// the sources with a checksum are hashed again if hash is set. The reset files get StatusNotStarted and
+// the fingerprint of the current source file, the reset is recorded like Reset does.
+// The completed files whose source changed are only reported.
+func (fmm *fileMetadataMap) invalidateChanged(hash bool) ([]InvalidatedFile, error) {
+	var (
+		invalidated []InvalidatedFile
+		errGeneral  error
+	)
+
+	fmm.m.Range(func(key, value any) bool {
+		meta := value.(FileMetadata)
+		if !meta.fingerprinted() {
+			return true
+		}
+
+		reset := meta.reset()
+		reset.Size, reset.ModTime, reset.Inode = 0, time.Time{}, 0
+		reset.Checksum = Checksum{Algorithm: meta.Checksum.Algorithm}
+
+		info, err := os.Stat(meta.SourcePath)
+		var reason string
+		switch {
+		case os.IsNotExist(err):
+			reason = ReasonMissing
+		case err != nil:
+			errGeneral = err
+			return false
+		default:
+			if reason, errGeneral = meta.changed(info, hash); errGeneral != nil {
+				return false
+			}
+			reset.Size, reset.ModTime, reset.Inode = info.Size(), info.ModTime(), inode(info)
+		}
+
+		if reason == "" {
+			return true
+		}
+		invalidated = append(invalidated, InvalidatedFile{Previous: meta, Reason: reason})
+		if meta.Status == StatusCompleted {
+			return true
+		}
+
+		fmm.mu.Lock()
+		errGeneral = fmm.resetFile(reset)
+		fmm.mu.Unlock()
+		return errGeneral == nil
+	})
+
+	return invalidated, errGeneral
+}
+
+// Invalidated returns the files whose source changed since the previous run, found when the lock file was loaded:
+// the files not completed, whose resume state was discarded, and the completed files, which were kept.
+func (tm *TransferManager) Invalidated() []InvalidatedFile {
+	invalidated := make([]InvalidatedFile, len(tm.invalidated))
+	copy(invalidated, tm.invalidated)
+	return invalidated
+}
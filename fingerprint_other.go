@@ -0,0 +1,10 @@
+//go:build !unix
+
+package reflux
+
+import "os"
+
+// inode returns 0, the inode number is not available on this platform.
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
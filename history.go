@@ -0,0 +1,215 @@
+package reflux
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// HistoryRecord is an immutable record of a status update of a file.
+type HistoryRecord struct {
+	Status           TransferStatus // The status set by the update
+	TimeStart        time.Time      // The time the transfer started
+	TimeEnd          time.Time      // The time the transfer ended, zero while in progress
+	BytesTransferred int            // The number of bytes transferred
+	ErrorMsg         string         // The error that occurred during the transfer
+	Hostname         string         // The hostname of the machine that recorded the update
+	RunID            string         // The ID of the run that recorded the update
+	Recorded         time.Time      // The time the update was recorded
+	Attempt          int            // The attempt of the transfer that recorded the update, 0 outside a transfer
+}
+
+// historyBucket returns the bucket holding the history of the file of the given key, creating it if needed.
+func historyBucket(tx Tx, key string) (Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(historyRootBucket.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists([]byte(key))
+}
+
+// attemptsBucket returns the bucket holding the attempts of the last transfer of the file of the given key,
+// creating it if needed.
+func attemptsBucket(tx Tx, key string) (Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists(attemptsRootBucket.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists([]byte(key))
+}
+
+// appendHistory appends a record of the given metadata, updated by the given attempt, to the history of the file.
+// The oldest records are removed once the history holds more records than the retention.
+// The record of an attempt is also kept with the attempts of the last transfer, which the retention does not remove.
+func (fmm *fileMetadataMap) appendHistory(tx Tx, meta FileMetadata, attempt int) error {
+	record, err := fmm.serializer.encode(HistoryRecord{
+		Status:           meta.Status,
+		TimeStart:        meta.TimeStart,
+		TimeEnd:          meta.TimeEnd,
+		BytesTransferred: meta.BytesTransferred,
+		ErrorMsg:         meta.ErrorMsg,
+		Hostname:         fmm.hostname,
+		RunID:            meta.RunID,
+		Recorded:         time.Now(),
+		Attempt:          attempt,
+	})
+	if err != nil {
+		return err
+	}
+
+	if attempt > 0 {
+		b, err := attemptsBucket(tx, meta.key())
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(attempt))
+		if err := b.Put(key, record); err != nil {
+			return err
+		}
+	}
+
+	b, err := historyBucket(tx, meta.key())
+	if err != nil {
+		return err
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := b.Put(key, record); err != nil {
+		return err
+	}
+
+	if fmm.historyRetention <= 0 {
+		return nil
+	}
+
+	// The keys are in insertion order, the oldest records come first.
+	var keys [][]byte
+	err = b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(keys)-fmm.historyRetention; i++ {
+		if err := b.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteHistory deletes the history and the attempts of the file of the given key.
+func deleteHistory(tx Tx, key string) error {
+	if err := deleteNested(tx, historyRootBucket, key); err != nil {
+		return err
+	}
+	return deleteAttempts(tx, key)
+}
+
+// deleteAttempts deletes the attempts of the last transfer of the file of the given key.
+func deleteAttempts(tx Tx, key string) error {
+	return deleteNested(tx, attemptsRootBucket, key)
+}
+
+// deleteNested deletes the bucket of the file of the given key nested in the given root bucket.
+func deleteNested(tx Tx, name bucket, key string) error {
+	root := tx.Bucket(name.Bytes())
+	if root == nil || root.Bucket([]byte(key)) == nil {
+		return nil
+	}
+	return root.DeleteBucket([]byte(key))
+}
+
+// loadHistory writes again the stale history and attempt records of every file, see loadRecords.
+func (tm *TransferManager) loadHistory(tx Tx) error {
+	for _, name := range []bucket{historyRootBucket, attemptsRootBucket} {
+		root := tx.Bucket(name.Bytes())
+		if root == nil {
+			continue
+		}
+
+		var keys []string
+		err := root.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err := loadRecords(tm.serializer, root.Bucket([]byte(key)), name, func([]byte, HistoryRecord) error {
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// History returns the status updates recorded for the given source path, oldest first.
+func (fmm *fileMetadataMap) History(sourcePath string) ([]HistoryRecord, error) {
+	var records []HistoryRecord
+
+	err := fmm.db.View(func(tx Tx) error {
+		root := tx.Bucket(historyRootBucket.Bytes())
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(fileKey(fmm.server, sourcePath)))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var record HistoryRecord
+			if _, err := fmm.serializer.load(historyRootBucket, k, v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+
+	return records, err
+}
+
+// Attempts returns the history records of the attempts of the last transfer of the given source path, oldest first.
+// The failed attempts that were retried are recorded with StatusFailed as soon as they end, the last one with
+// the final status. They are kept until a new transfer of the file starts or it is reset, whatever the history
+// retention.
+func (fmm *fileMetadataMap) Attempts(sourcePath string) ([]HistoryRecord, error) {
+	var attempts []HistoryRecord
+
+	err := fmm.db.View(func(tx Tx) error {
+		root := tx.Bucket(attemptsRootBucket.Bytes())
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(fileKey(fmm.server, sourcePath)))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var record HistoryRecord
+			if _, err := fmm.serializer.load(attemptsRootBucket, k, v, &record); err != nil {
+				return err
+			}
+			attempts = append(attempts, record)
+			return nil
+		})
+	})
+
+	return attempts, err
+}
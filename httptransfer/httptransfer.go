@@ -0,0 +1,494 @@
+// Package httptransfer provides the transfers of a TransferManager over HTTP and HTTPS.
+//
+// The Client uploads the files with PUT or POST and downloads them with GET. The transfers are resumed with
+// the Content-Range and Range headers from the bytes already transferred. The ETag and Last-Modified of the
+// remote file are stored in the transfer attributes of the file, see reflux.FileMetadataMap.Attributes, so a
+// transfer is never resumed on a remote file that changed in between. Each server keeps its own.
+//
+// Example:
+//
+//	client, err := httptransfer.FromManager(tm)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	files, err := tm.Files.Resume(client.UploadFrom)
+package httptransfer
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/ro-ag/reflux.v0"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ETagAttr         = "http.etag"          // The attribute of the file holding the ETag of the remote file
+	LastModifiedAttr = "http.last-modified" // The attribute of the file holding the Last-Modified of the remote file
+	URLAttr          = "http.url"           // The attribute of the file holding the URL of the remote file
+
+	drainSize = 256 << 10 // The maximum size of the response body read to reuse its connection
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("server scheme is not http or https")
+	ErrUnsupportedAuth   = errors.New("auth method not supported over HTTP")
+	ErrNoCredentials     = errors.New("no credential resolver set")
+	ErrRemoteChanged     = errors.New("remote file changed")
+	ErrUnexpectedStatus  = errors.New("unexpected HTTP status")
+)
+
+// Client transfers files to and from an HTTP server. Its methods are the transfers of a FileMetadataMap,
+// they can be called concurrently.
+type Client struct {
+	http          *http.Client           // Sends the requests
+	base          *url.URL               // The URL the paths are relative to
+	files         reflux.FileMetadataMap // The files of the server, whose transfer attributes hold the validators
+	method        string                 // The method of the uploads
+	header        http.Header            // The headers added to every request
+	authorization string                 // The Authorization header, empty if the server needs none
+}
+
+// FromManager returns a Client for the server info of the TransferManager, or for the profile set with WithServer.
+func FromManager(tm *reflux.TransferManager, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	info, err := tm.GetServerInfo()
+	if o.server != reflux.DefaultServer {
+		info, err = tm.Server(o.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(tm, info, opts...)
+}
+
+// New returns a Client for the given server, storing the validators of the remote files in the transfer
+// attributes of the files of the server profile set with WithServer. The scheme of the server must be
+// reflux.SchemeHTTP or reflux.SchemeHTTPS, the paths that are not absolute are relative to its BaseDir.
+func New(tm *reflux.TransferManager, info *reflux.ServerInfo, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if info.Scheme != reflux.SchemeHTTP && info.Scheme != reflux.SchemeHTTPS {
+		return nil, errors.Wrap(ErrUnsupportedScheme, info.Scheme)
+	}
+	host, err := info.HostPort()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		http:   o.client,
+		base:   &url.URL{Scheme: info.Scheme, Host: host, Path: "/" + strings.TrimPrefix(info.BaseDir, "/")},
+		files:  tm.Files.Server(o.server),
+		method: o.method,
+		header: o.header,
+	}
+
+	switch auth := info.Auth; auth.Method {
+	case reflux.AuthNone:
+	case reflux.AuthCredential:
+		if o.credentials == nil {
+			return nil, errors.Wrapf(ErrNoCredentials, "credential '%s'", auth.CredentialID)
+		}
+		if c.authorization, err = o.credentials(auth.CredentialID); err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve credential '%s'", auth.CredentialID)
+		}
+	default:
+		return nil, errors.Wrap(ErrUnsupportedAuth, string(auth.Method))
+	}
+
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: info.ConnectTimeout}).DialContext
+		transport.ResponseHeaderTimeout = info.IOTimeout
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// Upload is a reflux.Transfer uploading the local sourcePath to targetPath from the start.
+// It returns the bytes uploaded, 0 if the upload failed.
+func (c *Client) Upload(sourcePath string, targetPath string) (int, error) {
+	return c.upload(context.Background(), sourcePath, targetPath, 0, nil)
+}
+
+// UploadFrom is a reflux.ResumableTransfer uploading the local sourcePath to targetPath from offset.
+// The rest of the file is sent with a Content-Range header, conditioned on the remote file being unchanged
+// since the previous upload: ErrRemoteChanged is returned otherwise.
+func (c *Client) UploadFrom(sourcePath string, targetPath string, offset int) (int, error) {
+	return c.upload(context.Background(), sourcePath, targetPath, offset, nil)
+}
+
+// UploadFromContext is a reflux.ResumableContextTransfer uploading the local sourcePath to targetPath
+// like UploadFrom, the request being cancelled with ctx.
+func (c *Client) UploadFromContext(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+	return c.upload(ctx, sourcePath, targetPath, offset, nil)
+}
+
+// UploadProgress is a reflux.ProgressTransfer uploading the local sourcePath to targetPath like Upload.
+func (c *Client) UploadProgress(ctx context.Context, sourcePath string, targetPath string, progress *reflux.Progress) (int, error) {
+	return c.upload(ctx, sourcePath, targetPath, 0, progress)
+}
+
+// Download is a reflux.Transfer downloading the remote sourcePath to the local targetPath.
+// The data is written to targetPath with reflux.PartialSuffix and renamed once complete. A partial target left
+// by a previous attempt is resumed with a Range request if the remote file is unchanged, otherwise the file is
+// downloaded from the start. It returns the size of the target.
+func (c *Client) Download(sourcePath string, targetPath string) (int, error) {
+	offset, n, err := c.download(context.Background(), sourcePath, targetPath, -1, nil)
+	return offset + n, err
+}
+
+// DownloadFrom is a reflux.ResumableTransfer downloading the remote sourcePath to the local targetPath from offset
+// like reflux.CopyFileFrom. It returns ErrRemoteChanged if the remote file changed since the previous download,
+// the file must then be Reset. It returns the bytes written by the call, also when it fails.
+func (c *Client) DownloadFrom(sourcePath string, targetPath string, offset int) (int, error) {
+	_, n, err := c.download(context.Background(), sourcePath, targetPath, offset, nil)
+	return n, err
+}
+
+// DownloadFromContext is a reflux.ResumableContextTransfer downloading the remote sourcePath to the local
+// targetPath like DownloadFrom, the request being cancelled with ctx.
+func (c *Client) DownloadFromContext(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+	_, n, err := c.download(ctx, sourcePath, targetPath, offset, nil)
+	return n, err
+}
+
+// DownloadProgress is a reflux.ProgressTransfer downloading the remote sourcePath to the local targetPath
+// like Download. The bytes already held by the partial target are reported to progress first.
+func (c *Client) DownloadProgress(ctx context.Context, sourcePath string, targetPath string, progress *reflux.Progress) (int, error) {
+	offset, n, err := c.download(ctx, sourcePath, targetPath, -1, progress)
+	return offset + n, err
+}
+
+// Changed returns whether the remote file transferred for sourcePath changed since its transfer, comparing the
+// stored ETag, or Last-Modified, with the ones returned by a HEAD request. It returns false if the file
+// was not transferred yet or if the server returns no validator.
+func (c *Client) Changed(ctx context.Context, sourcePath string) (bool, error) {
+	attrs := c.files.Attributes(sourcePath)
+	target, ok, err := reflux.GetAttrIn[string](attrs, URLAttr)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	req, err := c.request(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	closeBody(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, statusError(resp)
+	}
+
+	for _, v := range []struct{ attr, header string }{{ETagAttr, "ETag"}, {LastModifiedAttr, "Last-Modified"}} {
+		stored, ok, err := reflux.GetAttrIn[string](attrs, v.attr)
+		if err != nil {
+			return false, err
+		}
+		if current := resp.Header.Get(v.header); ok && stored != "" && current != "" {
+			return current != stored, nil
+		}
+	}
+	return false, nil
+}
+
+// url returns the URL of a remote path. A URL is returned unchanged.
+func (c *Client) url(p string) string {
+	if u, err := url.Parse(p); err == nil && (u.Scheme == reflux.SchemeHTTP || u.Scheme == reflux.SchemeHTTPS) {
+		return p
+	}
+
+	u := *c.base
+	p = filepath.ToSlash(p)
+	if !path.IsAbs(p) {
+		p = path.Join(c.base.Path, p)
+	}
+	u.Path = p
+	return u.String()
+}
+
+// request returns a request with the headers of the client.
+func (c *Client) request(ctx context.Context, method string, target string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.header {
+		req.Header[key] = append([]string{}, values...)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	return req, nil
+}
+
+// upload uploads sourcePath to targetPath from offset and returns the bytes uploaded. The progress is optional.
+func (c *Client) upload(ctx context.Context, sourcePath string, targetPath string, offset int, progress *reflux.Progress) (int, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if offset < 0 || int64(offset) > size {
+		return 0, errors.Wrapf(reflux.ErrOffsetMismatch, "offset %d, source size %d", offset, size)
+	}
+	if offset > 0 && int64(offset) == size {
+		// The whole file was acknowledged by the server before the status was recorded
+		return 0, nil
+	}
+	if _, err := source.Seek(int64(offset), io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var body io.Reader = source
+	if progress != nil {
+		body = io.TeeReader(source, progress)
+	}
+	target := c.url(targetPath)
+	req, err := c.request(ctx, c.method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size - int64(offset)
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	attrs := c.files.Attributes(sourcePath)
+	if offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		if err := c.precondition(req, attrs, "If-Match", "If-Unmodified-Since"); err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	closeBody(resp)
+
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return 0, errors.Wrap(ErrRemoteChanged, target)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return 0, statusError(resp)
+	}
+
+	if err := c.record(attrs, target, resp.Header); err != nil {
+		return 0, err
+	}
+	return int(size) - offset, nil
+}
+
+// download downloads sourcePath to targetPath from offset, or from the size of the partial target if offset is
+// negative. It returns the offset the download started from and the bytes written. The progress is optional.
+func (c *Client) download(ctx context.Context, sourcePath string, targetPath string, offset int, progress *reflux.Progress) (start int, n int, err error) {
+	partialPath := targetPath + reflux.PartialSuffix
+	restart := offset < 0
+	if restart {
+		offset = 0
+		if info, err := os.Stat(partialPath); err == nil {
+			offset = int(info.Size())
+		}
+	}
+
+	attrs := c.files.Attributes(sourcePath)
+	source := c.url(sourcePath)
+	req, err := c.request(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if err := c.precondition(req, attrs, "If-Range", "If-Range"); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if first, _, ok := contentRange(resp.Header.Get("Content-Range")); !ok || first != int64(offset) {
+			return 0, 0, errors.Wrapf(ErrUnexpectedStatus, "Content-Range '%s' for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		if offset > 0 && !restart {
+			return 0, 0, errors.Wrapf(ErrRemoteChanged, "'%s' sent in full instead of from offset %d", source, offset)
+		}
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial target already holds the whole file
+		_, size, ok := contentRange(resp.Header.Get("Content-Range"))
+		if !ok || size != int64(offset) {
+			return 0, 0, statusError(resp)
+		}
+	default:
+		return 0, 0, statusError(resp)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	partial, err := os.OpenFile(partialPath, flags, 0666)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer partial.Close()
+
+	if offset > 0 {
+		info, err := partial.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+		if info.Size() < int64(offset) {
+			return 0, 0, errors.Wrapf(reflux.ErrOffsetMismatch, "offset %d, '%s' holds %d bytes", offset, partialPath, info.Size())
+		}
+		if err := partial.Truncate(int64(offset)); err != nil {
+			return 0, 0, err
+		}
+		if _, err := partial.Seek(int64(offset), io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		if progress != nil {
+			if err := progress.Add(offset); err != nil {
+				return offset, 0, err
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if n, err = reflux.CopyChunks(ctx, partial, resp.Body, progress); err != nil {
+			// Keep the bytes written so the download can be resumed from them
+			_ = partial.Sync()
+			return offset, n, err
+		}
+		if err := c.record(attrs, source, resp.Header); err != nil {
+			return offset, n, err
+		}
+	}
+
+	if err := partial.Sync(); err != nil {
+		return offset, n, err
+	}
+	if err := partial.Close(); err != nil {
+		return offset, n, err
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := os.Chtimes(partialPath, time.Now(), modTime); err != nil {
+			return offset, n, err
+		}
+	}
+	return offset, n, os.Rename(partialPath, targetPath)
+}
+
+// precondition sets the header conditioning the request on the remote file being unchanged, to the stored ETag
+// with etagHeader or to the stored Last-Modified with dateHeader. No header is set if no validator is stored.
+func (c *Client) precondition(req *http.Request, attrs reflux.AttributesMap, etagHeader string, dateHeader string) error {
+	etag, ok, err := reflux.GetAttrIn[string](attrs, ETagAttr)
+	if err != nil {
+		return err
+	}
+	if ok && etag != "" {
+		req.Header.Set(etagHeader, etag)
+		return nil
+	}
+
+	lastModified, ok, err := reflux.GetAttrIn[string](attrs, LastModifiedAttr)
+	if err != nil {
+		return err
+	}
+	if ok && lastModified != "" {
+		req.Header.Set(dateHeader, lastModified)
+	}
+	return nil
+}
+
+// record stores the URL and the validators of the remote file in the transfer attributes of the file.
+func (c *Client) record(attrs reflux.AttributesMap, remote string, header http.Header) error {
+	values := map[string]string{
+		URLAttr:          remote,
+		ETagAttr:         header.Get("ETag"),
+		LastModifiedAttr: header.Get("Last-Modified"),
+	}
+	for key, value := range values {
+		if err := reflux.SetAttrIn(attrs, key, value); err != nil {
+			return errors.Wrapf(err, "failed to record '%s'", key)
+		}
+	}
+	return nil
+}
+
+// contentRange parses the first byte and the complete length of a Content-Range header,
+// "bytes first-last/length" or "bytes */length". The first byte is -1 in the latter.
+func contentRange(header string) (first int64, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+
+	length, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if rng == "*" {
+		return -1, length, true
+	}
+
+	firstByte, _, found := strings.Cut(rng, "-")
+	if first, err = strconv.ParseInt(firstByte, 10, 64); err != nil || !found {
+		return 0, 0, false
+	}
+	return first, length, true
+}
+
+// statusError returns the error of an unexpected response.
+func statusError(resp *http.Response) error {
+	return errors.Wrapf(ErrUnexpectedStatus, "%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+}
+
+// closeBody drains and closes the body of a response, so its connection is reused.
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, drainSize))
+	_ = resp.Body.Close()
+}
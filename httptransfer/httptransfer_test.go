@@ -0,0 +1,331 @@
+package httptransfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"gopkg.in/ro-ag/reflux.v0"
+	"gopkg.in/ro-ag/reflux.v0/httptransfer"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	server := newServer(t, "Bearer secret-token")
+
+	tm, err := reflux.NewTransferManager(reflux.WithLockFile(filepath.Join(dir, "http.lock")), reflux.WithSignalHandling(false))
+	if err != nil {
+		t.Fatalf("Failed to create TransferManager: %v", err)
+	}
+	defer func() {
+		if err := tm.Finish(); err != nil {
+			t.Errorf("Failed to finish TransferManager: %v", err)
+		}
+	}()
+
+	err = tm.StoreOrUpdateServerInfo(&reflux.ServerInfo{
+		Address: "127.0.0.1",
+		Port:    server.port,
+		User:    "user",
+		Scheme:  reflux.SchemeHTTP,
+		BaseDir: "files",
+		Auth:    reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "token"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to store server info: %v", err)
+	}
+	client, err := httptransfer.FromManager(tm, httptransfer.WithCredentials(func(id string) (string, error) {
+		return "Bearer secret-" + id, nil
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	data := make([]byte, 300<<10)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	offset := 100 << 10
+
+	// Upload a file, its validators are recorded in its attributes
+	sourcePath := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(sourcePath, data, 0600); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	if err := tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: "up/a.bin"}); err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	if _, err := tm.Files.OperateProgress(client.UploadProgress); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	if meta, _ := tm.Files.Load(sourcePath); meta.Status != reflux.StatusCompleted || meta.BytesTransferred != len(data) {
+		t.Errorf("Unexpected file metadata after upload: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	server.check(t, "/files/up/a.bin", data)
+	attrs := tm.Files.Attributes(sourcePath)
+	if etag, _, _ := reflux.GetAttrIn[string](attrs, httptransfer.ETagAttr); etag != server.etag("/files/up/a.bin") {
+		t.Errorf("Unexpected recorded ETag: %q", etag)
+	}
+
+	// Each server keeps its own validators of the same file
+	err = tm.StoreServer("dr", &reflux.ServerInfo{Address: "127.0.0.1", Port: server.port, User: "user",
+		Scheme: reflux.SchemeHTTP, BaseDir: "dr", Auth: reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "token"}})
+	if err != nil {
+		t.Fatalf("Failed to store server: %v", err)
+	}
+	dr, err := httptransfer.FromManager(tm, httptransfer.WithServer("dr"), httptransfer.WithCredentials(func(id string) (string, error) {
+		return "Bearer secret-" + id, nil
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	drFiles := tm.Files.Server("dr")
+	if err := drFiles.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: "up/a.bin"}); err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	if _, err := drFiles.OperateProgress(dr.UploadProgress); err != nil {
+		t.Fatalf("Failed to upload to dr: %v", err)
+	}
+	server.check(t, "/dr/up/a.bin", data)
+	for files, expected := range map[reflux.FileMetadataMap]string{tm.Files: "/files/up/a.bin", drFiles: "/dr/up/a.bin"} {
+		if u, _, _ := reflux.GetAttrIn[string](files.Attributes(sourcePath), httptransfer.URLAttr); !strings.HasSuffix(u, expected) {
+			t.Errorf("Unexpected recorded URL: %q, expected %s", u, expected)
+		}
+	}
+
+	// An interrupted upload is resumed with a Content-Range
+	server.put("/files/up/a.bin", data[:offset])
+	if err := reflux.SetAttrIn(attrs, httptransfer.ETagAttr, server.etag("/files/up/a.bin")); err != nil {
+		t.Fatalf("Failed to set ETag: %v", err)
+	}
+	err = tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: "up/a.bin",
+		Status: reflux.StatusInterrupted, BytesTransferred: offset})
+	if err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	if _, err := tm.Files.Resume(client.UploadFrom); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if meta, _ := tm.Files.Load(sourcePath); meta.Status != reflux.StatusCompleted || meta.BytesTransferred != len(data) {
+		t.Errorf("Unexpected file metadata after resumed upload: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	server.check(t, "/files/up/a.bin", data)
+
+	// The upload is not resumed on a remote file changed in between
+	server.put("/files/up/a.bin", []byte("changed"))
+	if _, err := client.UploadFrom(sourcePath, "up/a.bin", offset); !errors.Is(err, httptransfer.ErrRemoteChanged) {
+		t.Errorf("Expected ErrRemoteChanged, got %v", err)
+	}
+
+	// Download a file, the partial target left by a previous attempt is resumed with a Range request
+	server.put("/files/down/b.bin", data)
+	targetPath := filepath.Join(dir, "b.bin")
+	if n, err := client.Download("down/b.bin", targetPath); err != nil || n != len(data) {
+		t.Fatalf("Unexpected download: %d, %v", n, err)
+	}
+	checkLocal(t, targetPath, data)
+
+	if err := os.WriteFile(targetPath+reflux.PartialSuffix, append(append([]byte{}, data[:offset]...), "garbage"...), 0600); err != nil {
+		t.Fatalf("Failed to write partial target: %v", err)
+	}
+	err = tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: "down/b.bin", TargetPath: targetPath,
+		Status: reflux.StatusFailed, BytesTransferred: offset})
+	if err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	if _, err := tm.Files.Resume(client.DownloadFrom); err != nil {
+		t.Fatalf("Failed to resume download: %v", err)
+	}
+	if meta, _ := tm.Files.Load("down/b.bin"); meta.Status != reflux.StatusCompleted || meta.BytesTransferred != len(data) {
+		t.Errorf("Unexpected file metadata after resumed download: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	checkLocal(t, targetPath, data)
+	if ranges := server.rangeRequests("/files/down/b.bin"); ranges != 1 {
+		t.Errorf("Unexpected number of range requests: %d", ranges)
+	}
+
+	// A changed remote file is detected, the download is not resumed on it
+	if changed, err := client.Changed(context.Background(), "down/b.bin"); err != nil || changed {
+		t.Errorf("Unchanged remote file reported changed: %v", err)
+	}
+	changed := append([]byte("changed "), data...)
+	server.put("/files/down/b.bin", changed)
+	if changed, err := client.Changed(context.Background(), "down/b.bin"); err != nil || !changed {
+		t.Errorf("Changed remote file not detected: %v", err)
+	}
+	if err := os.WriteFile(targetPath+reflux.PartialSuffix, data[:offset], 0600); err != nil {
+		t.Fatalf("Failed to write partial target: %v", err)
+	}
+	if _, err := client.DownloadFrom("down/b.bin", targetPath, offset); !errors.Is(err, httptransfer.ErrRemoteChanged) {
+		t.Errorf("Expected ErrRemoteChanged, got %v", err)
+	}
+
+	// Without a recorded offset the changed file is downloaded from the start
+	if n, err := client.Download("down/b.bin", targetPath); err != nil || n != len(changed) {
+		t.Errorf("Unexpected download of changed file: %d, %v", n, err)
+	}
+	checkLocal(t, targetPath, changed)
+
+	// The requests without the credential are rejected
+	unauthorized, err := httptransfer.New(tm, &reflux.ServerInfo{Address: "127.0.0.1", Port: server.port, User: "user", Scheme: reflux.SchemeHTTP})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := unauthorized.Upload(sourcePath, "up/a.bin"); !errors.Is(err, httptransfer.ErrUnexpectedStatus) {
+		t.Errorf("Expected ErrUnexpectedStatus, got %v", err)
+	}
+
+	// Only the http servers and the credentials are supported
+	if _, err := httptransfer.New(tm, &reflux.ServerInfo{Address: "localhost", Port: 22, User: "user", Scheme: reflux.SchemeSFTP}); !errors.Is(err, httptransfer.ErrUnsupportedScheme) {
+		t.Errorf("Expected ErrUnsupportedScheme, got %v", err)
+	}
+	if _, err := httptransfer.New(tm, &reflux.ServerInfo{Address: "localhost", Port: 443, User: "user", Scheme: reflux.SchemeHTTPS,
+		Auth: reflux.AuthRef{Method: reflux.AuthKey, KeyPath: "key"}}); !errors.Is(err, httptransfer.ErrUnsupportedAuth) {
+		t.Errorf("Expected ErrUnsupportedAuth, got %v", err)
+	}
+}
+
+// testServer is an HTTP file server accepting the uploads with PUT, resumed with a Content-Range header.
+type testServer struct {
+	port          int
+	authorization string
+	mu            sync.Mutex
+	files         map[string][]byte    // The content of the files, by path
+	modTimes      map[string]time.Time // The modification time of the files, by path
+	ranges        map[string]int       // The number of range requests, by path
+}
+
+// newServer starts an HTTP server requiring the given Authorization header.
+func newServer(t *testing.T, authorization string) *testServer {
+	t.Helper()
+
+	s := &testServer{
+		authorization: authorization,
+		files:         make(map[string][]byte),
+		modTimes:      make(map[string]time.Time),
+		ranges:        make(map[string]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(server.Close)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	s.port, _ = strconv.Atoi(port)
+	return s
+}
+
+// put sets the content of a file.
+func (s *testServer) put(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = append([]byte{}, data...)
+	s.modTimes[path] = time.Now().Truncate(time.Second)
+}
+
+// rangeRequests returns the number of range requests of a file.
+func (s *testServer) rangeRequests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ranges[path]
+}
+
+// etag returns the ETag of a file.
+func (s *testServer) etag(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.etagLocked(path)
+}
+
+// etagLocked returns the ETag of a file, the lock must be held.
+func (s *testServer) etagLocked(path string) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(s.files[path]))
+}
+
+// check checks the content of a file.
+func (s *testServer) check(t *testing.T, path string, data []byte) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.files[path], data) {
+		t.Errorf("Remote file '%s' differs: %d bytes", path, len(s.files[path]))
+	}
+}
+
+// serveHTTP serves the files with GET and HEAD and stores them with PUT.
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != s.authorization {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.Lock()
+		if r.Header.Get("Range") != "" {
+			s.ranges[r.URL.Path]++
+		}
+		data, ok := s.files[r.URL.Path]
+		etag, modTime := s.etagLocked(r.URL.Path), s.modTimes[r.URL.Path]
+		s.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, r.URL.Path, modTime, bytes.NewReader(data))
+
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+			if r.Header.Get("If-Match") != s.etagLocked(r.URL.Path) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			var first, last, size int
+			if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &size); err != nil ||
+				first != len(s.files[r.URL.Path]) || last-first+1 != len(body) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			body = append(s.files[r.URL.Path], body...)
+		}
+		s.files[r.URL.Path] = body
+		s.modTimes[r.URL.Path] = time.Now().Truncate(time.Second)
+		w.Header().Set("ETag", s.etagLocked(r.URL.Path))
+		w.Header().Set("Last-Modified", s.modTimes[r.URL.Path].UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// checkLocal checks the content of a downloaded file.
+func checkLocal(t *testing.T, path string, data []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Local file '%s' differs: %d bytes, %v", path, len(got), err)
+	}
+	if _, err := os.Stat(path + reflux.PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("Partial target of '%s' left: %v", path, err)
+	}
+}
@@ -0,0 +1,67 @@
+package httptransfer
+
+import (
+	"gopkg.in/ro-ag/reflux.v0"
+	"net/http"
+)
+
+// CredentialFunc returns the value of the Authorization header for the secret kept under the given ID
+// in a credential store, such as "Bearer <token>". It resolves the servers authenticated with reflux.AuthCredential.
+type CredentialFunc func(id string) (string, error)
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	client      *http.Client   // The HTTP client sending the requests, nil for one built from the server info
+	method      string         // The method of the uploads
+	header      http.Header    // The headers added to every request
+	credentials CredentialFunc // Resolves the credential IDs, nil if no credential store is used
+	server      string         // The server profile of the files transferred, reflux.DefaultServer by default
+}
+
+// defaultOptions returns the options of a Client.
+func defaultOptions() *options {
+	return &options{
+		method: http.MethodPut,
+		header: make(http.Header),
+		server: reflux.DefaultServer,
+	}
+}
+
+// WithHTTPClient sets the HTTP client sending the requests. The timeouts of the server info are then ignored.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithUploadMethod sets the method of the uploads, http.MethodPut by default. Resumed uploads send the same method.
+func WithUploadMethod(method string) Option {
+	return func(o *options) {
+		o.method = method
+	}
+}
+
+// WithHeader adds a header to every request.
+func WithHeader(key string, value string) Option {
+	return func(o *options) {
+		o.header.Add(key, value)
+	}
+}
+
+// WithCredentials sets the resolver of the credential IDs of the servers authenticated with reflux.AuthCredential.
+func WithCredentials(credentials CredentialFunc) Option {
+	return func(o *options) {
+		o.credentials = credentials
+	}
+}
+
+// WithServer sets the server profile the files are transferred to, reflux.DefaultServer by default.
+// FromManager reads the profile and the validators are kept in the transfer attributes of its files,
+// so the same file is resumed correctly on each server.
+func WithServer(name string) Option {
+	return func(o *options) {
+		o.server = name
+	}
+}
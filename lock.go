@@ -0,0 +1,173 @@
+package reflux
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+const (
+	lockHolderKey    = "Holder"  // The key of the LockHolder in the lock bucket
+	holderFileSuffix = ".holder" // The suffix of the file next to the lock file naming its holder
+)
+
+var ErrLocked = errors.New("lock file is held by another process")
+
+// LockHolder identifies the process holding a lock file.
+type LockHolder struct {
+	PID      int       // The process ID of the holder
+	Hostname string    // The hostname of the machine running the holder
+	Started  time.Time // The time the holder opened the lock file
+}
+
+// alive returns whether the holder may be running, the current process excepted.
+// The liveness of a holder running on another host cannot be checked, it is reported as alive if remote is true.
+func (h LockHolder) alive(remote bool) bool {
+	hostname, _ := os.Hostname()
+	if h.Hostname != hostname {
+		return remote
+	}
+	if h.PID == os.Getpid() || h.PID <= 0 {
+		return false
+	}
+	return processAlive(h.PID)
+}
+
+// LockedError is returned by NewTransferManager when the lock file is held by another process.
+// It matches ErrLocked with errors.Is.
+type LockedError struct {
+	Path   string     // The path of the lock file
+	Holder LockHolder // The process holding the lock file, zero if it could not be read
+}
+
+// Error returns the description of the holder.
+func (e *LockedError) Error() string {
+	if e.Holder.PID == 0 {
+		return fmt.Sprintf("%s: '%s'", ErrLocked, e.Path)
+	}
+	return fmt.Sprintf("%s: '%s' held by pid %d on %s since %s", ErrLocked, e.Path,
+		e.Holder.PID, e.Holder.Hostname, e.Holder.Started.Format(time.RFC3339))
+}
+
+// Unwrap returns ErrLocked.
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// currentHolder returns the LockHolder of the running process.
+func currentHolder() LockHolder {
+	hostname, _ := os.Hostname()
+	return LockHolder{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Started:  time.Now(),
+	}
+}
+
+// loadLockHolder reads the LockHolder recorded in the lock bucket.
+// The holder is always encoded with the default codec, it is read before the options of the holder are known.
+func loadLockHolder(tx Tx) (LockHolder, bool, error) {
+	var holder LockHolder
+
+	b := tx.Bucket(lockBucket.Bytes())
+	if b == nil {
+		return holder, false, nil
+	}
+
+	v := b.Get([]byte(lockHolderKey))
+	if v == nil {
+		return holder, false, nil
+	}
+
+	if err := defaultSerializer.decode(v, &holder); err != nil {
+		return holder, false, err
+	}
+	return holder, true, nil
+}
+
+// holderPath returns the path of the file naming the holder of a lock file.
+func holderPath(lockFilePath string) string {
+	return lockFilePath + holderFileSuffix
+}
+
+// readLockHolder reads the LockHolder of a lock file held by another process.
+// The lock file cannot be opened while it is held, the holder is read from the file written next to it.
+func readLockHolder(path string) (LockHolder, error) {
+	var holder LockHolder
+
+	data, err := os.ReadFile(holderPath(path))
+	if err != nil {
+		return holder, err
+	}
+	err = defaultSerializer.decode(data, &holder)
+	return holder, err
+}
+
+// acquireLock records the current process as the holder of the lock file.
+// If a process that may be running is recorded as the holder, the lock file is shared on a filesystem
+// that does not enforce the file lock, such as NFS, and a *LockedError is returned unless the takeover
+// is forced. A holder on another host is only considered running with WithStrictLock.
+// A holder that is no longer running left a stale lock, it is returned by PreviousHolder.
+// The holder is also written next to the lock file, where the other processes can read it.
+func (tm *TransferManager) acquireLock(o *options) error {
+	record, err := defaultSerializer.encode(currentHolder())
+	if err != nil {
+		return err
+	}
+
+	err = tm.db.Update(func(tx Tx) error {
+		previous, ok, err := loadLockHolder(tx)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if previous.alive(o.strictLock) && !o.lockTakeover {
+				return &LockedError{Path: tm.lockFilePath, Holder: previous}
+			}
+			tm.previousHolder = &previous
+		}
+
+		b, err := tx.CreateBucketIfNotExists(lockBucket.Bytes())
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(lockHolderKey), record)
+	})
+	if err != nil {
+		return err
+	}
+	tm.holding = true
+	if !tm.ownsStore {
+		return nil
+	}
+	return os.WriteFile(holderPath(tm.lockFilePath), record, o.fileMode)
+}
+
+// releaseLock removes the current process as the holder of the lock file.
+func (tm *TransferManager) releaseLock() error {
+	err := tm.db.Update(func(tx Tx) error {
+		b := tx.Bucket(lockBucket.Bytes())
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(lockHolderKey))
+	})
+	if err != nil || !tm.ownsStore {
+		return err
+	}
+	if err := os.Remove(holderPath(tm.lockFilePath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PreviousHolder returns the process that held the lock file before and stopped without closing the
+// TransferManager, usually because it crashed. It returns false if the lock file was released properly.
+func (tm *TransferManager) PreviousHolder() (LockHolder, bool) {
+	if tm.previousHolder == nil {
+		return LockHolder{}, false
+	}
+	return *tm.previousHolder, true
+}
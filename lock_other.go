@@ -0,0 +1,15 @@
+//go:build !unix
+
+package reflux
+
+import "os"
+
+// processAlive returns whether a process with the given PID is running on this host.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package reflux
+
+import "syscall"
+
+// processAlive returns whether a process with the given PID is running on this host.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -1,10 +1,8 @@
 package reflux
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"github.com/pkg/errors"
-	bolt "go.etcd.io/bbolt"
 	"sync"
 	"time"
 )
@@ -18,20 +16,95 @@ type FileMetadata struct {
 	TimeStart        time.Time      // The time the transfer started
 	TimeEnd          time.Time      // The time the transfer ended
 	ErrorMsg         string         // The error that occurred during the transfer
+	Attempts         int            // The number of attempts of the last transfer, see FileMetadataMap.Attempts
+	Size             int64          // The expected size of the file in bytes, 0 if unknown
+	ModTime          time.Time      // The modification time of the source file when it was registered
+	Inode            uint64         // The inode of the source file when it was registered, 0 if unknown
+	RunID            string         // The ID of the run that recorded the last status update
+	Checksum         Checksum       // The content hash of the source file, zero if unknown
+	Server           string         // The name of the server profile the file is transferred to, empty for DefaultServer
+}
+
+// serverSeparator separates the server from the source path in the key of the files of a named server.
+const serverSeparator = "\x00"
+
+// fileKey returns the key of the file metadata: the source path, prefixed by the server for a named server.
+func fileKey(server string, sourcePath string) string {
+	if server == "" {
+		return sourcePath
+	}
+	return server + serverSeparator + sourcePath
+}
+
+// key returns the key of the file metadata.
+func (meta FileMetadata) key() string {
+	return fileKey(meta.Server, meta.SourcePath)
 }
 
 type fileMetadataMap struct {
-	m  *sync.Map
-	db *bolt.DB
+	m   *sync.Map
+	db  Store
+	mu  *sync.Mutex     // Serializes the read-modify-write of the status updates, shared by the server views
+	ctx context.Context // The context of the TransferManager, no new transfers are started once it is cancelled
+
+	retryPolicy      RetryPolicy   // The policy applied when a transfer fails
+	progress         *progressHub  // Publishes the progress reports to the subscribers
+	progressInterval time.Duration // The minimum time between two writes of the progress to the database
+	historyRetention int           // The maximum number of history records kept per file, 0 keeps all
+	hostname         string        // The hostname recorded in the history
+	runID            string        // The ID of the run stamped on the status updates
+	serializer       *serializer   // Encodes the records of the files and their history
+	attributes       AttributesMap // The attributes, whose file scopes are deleted along with the files
+	server           string        // The server of the files of this view, empty for DefaultServer
 }
 
+// Transfer transfers the file from sourcePath to targetPath and returns the number of bytes transferred.
 type Transfer func(sourcePath string, targetPath string) (int, error)
 
+// ContextTransfer transfers the file from sourcePath to targetPath and returns the number of bytes transferred.
+// The transfer should return as soon as possible once ctx is cancelled.
+type ContextTransfer func(ctx context.Context, sourcePath string, targetPath string) (int, error)
+
+// ProgressTransfer transfers the file from sourcePath to targetPath and returns the number of bytes transferred.
+// The bytes written to the target should be reported to progress while the transfer is running.
+type ProgressTransfer func(ctx context.Context, sourcePath string, targetPath string, progress *Progress) (int, error)
+
+// ResumableTransfer transfers the file from sourcePath to targetPath starting at the given byte offset
+// and returns the number of bytes transferred by this call.
+type ResumableTransfer func(sourcePath string, targetPath string, offset int) (int, error)
+
+// ResumableContextTransfer transfers the file from sourcePath to targetPath starting at the given byte offset
+// and returns the number of bytes transferred by this call.
+// The transfer should return as soon as possible once ctx is cancelled.
+type ResumableContextTransfer func(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error)
+
+// TransferResult is the outcome of the transfer of a single file.
+type TransferResult struct {
+	Metadata FileMetadata // The file metadata after the transfer
+	Err      error        // The error returned by the transfer or by the status bookkeeping, nil on success
+}
+
 // FileMetadataMap provides a synchronized map for storing and managing file metadata.
 type FileMetadataMap interface {
 
 	// loadAll loads the file metadata from the database into the TransferManager's files map.
-	loadAll(tx *bolt.Tx) error
+	loadAll(tx Tx) error
+
+	// invalidateChanged resets the files not completed whose source changed since their fingerprint was recorded.
+	invalidateChanged(hash bool) ([]InvalidatedFile, error)
+
+	// All returns the file metadata of every server, whatever the server of the view.
+	All() []FileMetadata
+
+	// Attributes returns the attributes scoped to the transfer of the file of the given source path to the server
+	// of the view, where the transfers keep their resume state. Unlike AttributesMap.File, each server has its own.
+	// They are deleted along with the file metadata by Delete.
+	Attributes(sourcePath string) AttributesMap
+
+	// Server returns the view of the files transferred to the server profile of the given name.
+	// The files of each server have their own status, so a file can be transferred to several servers.
+	// The methods of the view only see the files of its server, StoreOrUpdate assigns them to it.
+	Server(name string) FileMetadataMap
 
 	// sync synchronizes the file metadata in the database with the file metadata in the TransferManager's files map.
 	sync() error
@@ -46,15 +119,53 @@ type FileMetadataMap interface {
 	// Delete deletes the file metadata for the given source path.
 	Delete(sourcePath string) error
 
+	// EnqueueTree stores the metadata of the files of the srcRoot directory selected by opts, targeted below dstRoot.
+	// The files already known keep their state.
+	EnqueueTree(srcRoot string, dstRoot string, opts TreeOptions) ([]FileMetadata, error)
+
 	// Operate operates on the file metadata for the given source path.
+	// ErrInvalidTransition is returned, before any transfer, when a file is completed.
 	Operate(op Transfer) ([]FileMetadata, error)
 
+	// OperateContext operates on the file metadata, handing the TransferManager context to the transfer.
+	OperateContext(op ContextTransfer) ([]FileMetadata, error)
+
+	// OperateProgress operates on the file metadata, handing a progress reporter to the transfer.
+	OperateProgress(op ProgressTransfer) ([]FileMetadata, error)
+
+	// OperateConcurrent executes the transfer of every file using the given number of workers.
+	// Like Operate, it returns ErrInvalidTransition when a file is completed.
+	OperateConcurrent(ctx context.Context, op Transfer, workers int) ([]TransferResult, error)
+
+	// OperateConcurrentContext executes the transfer of every file using the given number of workers,
+	// handing the context to the transfer.
+	OperateConcurrentContext(ctx context.Context, op ContextTransfer, workers int) ([]TransferResult, error)
+
+	// Resume operates on the files that have not been completed, continuing from the recorded byte offset.
+	Resume(op ResumableTransfer) ([]FileMetadata, error)
+
+	// ResumeContext operates on the files that have not been completed like Resume, handing the
+	// TransferManager context to the transfer.
+	ResumeContext(op ResumableContextTransfer) ([]FileMetadata, error)
+
+	// Verify checks the integrity of the transfer of the file for the given source path.
+	Verify(sourcePath string, verifier Verifier) error
+
 	// GetSlice returns a slice of file metadata
 	GetSlice() ([]FileMetadata, error)
 
 	// UpdateStatus updates the status of the file metadata for the given source path.
 	UpdateStatus(sourcePath string, status TransferStatus, bytesTransferred int, err error) error
 
+	// Reset moves the file metadata for the given source path back to a clean StatusNotStarted.
+	Reset(sourcePath string) error
+
+	// History returns the status updates recorded for the given source path, oldest first.
+	History(sourcePath string) ([]HistoryRecord, error)
+
+	// Attempts returns the history records of the attempts of the last transfer of the given source path.
+	Attempts(sourcePath string) ([]HistoryRecord, error)
+
 	// Start starts the transfer for the given source path.
 	Start(sourcePath string) error
 
@@ -66,19 +177,13 @@ type FileMetadataMap interface {
 }
 
 // loadAll loads the file metadata from the database into the TransferManager's files map.
-func (fmm *fileMetadataMap) loadAll(tx *bolt.Tx) error {
+func (fmm *fileMetadataMap) loadAll(tx Tx) error {
 	b := tx.Bucket(filesBucket.Bytes())
 	if b == nil {
 		return nil
 	}
 
-	return b.ForEach(func(k, v []byte) error {
-		var metadata FileMetadata
-		dec := gob.NewDecoder(bytes.NewReader(v))
-		err := dec.Decode(&metadata)
-		if err != nil {
-			return err
-		}
+	return loadRecords(fmm.serializer, b, filesBucket, func(k []byte, metadata FileMetadata) error {
 		fmm.m.Store(string(k), metadata)
 		return nil
 	})
@@ -86,66 +191,141 @@ func (fmm *fileMetadataMap) loadAll(tx *bolt.Tx) error {
 
 // StoreOrUpdate stores or updates the file metadata in the database.
 // It encodes the file metadata and stores it in the Lock File (BoltDB database).
+// The metadata without server is assigned to the server of the view.
 func (fmm *fileMetadataMap) StoreOrUpdate(metadata FileMetadata) error {
+	if metadata.Server == "" {
+		metadata.Server = fmm.server
+	}
 
-	err := fmm.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(filesBucket.Bytes())
-		if err != nil {
-			return err
-		}
-
-		// Convert the file metadata to bytes.
-		buf := new(bytes.Buffer)
-		enc := gob.NewEncoder(buf)
-		if err := enc.Encode(metadata); err != nil {
-			return err
-		}
-		return b.Put([]byte(metadata.SourcePath), buf.Bytes())
+	err := fmm.db.Update(func(tx Tx) error {
+		return fmm.putFile(tx, metadata)
 	})
 
 	if err != nil {
 		return err
 	}
 
-	fmm.m.Store(metadata.SourcePath, metadata)
+	fmm.m.Store(metadata.key(), metadata)
 
 	return nil
 }
 
-// Load returns the file metadata for the given source path.
-func (fmm *fileMetadataMap) syncFile(sourcePath string) error {
-	meta, ok := fmm.m.Load(sourcePath)
+// putFile encodes the file metadata and stores it in the files bucket.
+func (fmm *fileMetadataMap) putFile(tx Tx, metadata FileMetadata) error {
+	b, err := tx.CreateBucketIfNotExists(filesBucket.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Convert the file metadata to bytes.
+	record, err := fmm.serializer.encode(metadata)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(metadata.key()), record)
+}
+
+// syncFile writes the file metadata of the given key to the database.
+func (fmm *fileMetadataMap) syncFile(key string) error {
+	meta, ok := fmm.m.Load(key)
 	if !ok {
-		return errors.Errorf("'%s' file key not found in map", sourcePath)
+		return errors.Errorf("'%s' file key not found in map", key)
 	}
-	return fmm.StoreOrUpdate(meta.(FileMetadata))
+	// The metadata is written as is, StoreOrUpdate would assign it to the server of the view.
+	return fmm.db.Update(func(tx Tx) error {
+		return fmm.putFile(tx, meta.(FileMetadata))
+	})
 }
 
 // Load returns the file metadata for the given source path.
 func (fmm *fileMetadataMap) Load(sourcePath string) (FileMetadata, bool) {
-	meta, ok := fmm.m.Load(sourcePath)
+	meta, ok := fmm.m.Load(fileKey(fmm.server, sourcePath))
 	if !ok {
 		return FileMetadata{}, false
 	}
 	return meta.(FileMetadata), true
 }
 
-// Delete deletes the file metadata for the given source path.
+// Delete deletes the file metadata, the history and the transfer attributes for the given source path.
+// The scoped attributes of the file are deleted once it is no longer transferred to any server.
 func (fmm *fileMetadataMap) Delete(sourcePath string) error {
-	err := fmm.db.Update(func(tx *bolt.Tx) error {
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
+	key := fileKey(fmm.server, sourcePath)
+	orphan := !fmm.shared(key, sourcePath)
+
+	err := fmm.db.Update(func(tx Tx) error {
+		if err := deleteHistory(tx, key); err != nil {
+			return err
+		}
+		if err := fmm.attributes.deleteScope(tx, transferAttributesBucket, key); err != nil {
+			return err
+		}
+		if orphan {
+			if err := fmm.attributes.deleteScope(tx, fileAttributesBucket, sourcePath); err != nil {
+				return err
+			}
+		}
+
 		b := tx.Bucket(filesBucket.Bytes())
 		if b == nil {
 			return nil
 		}
-		return b.Delete([]byte(sourcePath))
+		return b.Delete([]byte(key))
 	})
 	if err != nil {
 		return err
 	}
-	fmm.m.Delete(sourcePath)
+	fmm.m.Delete(key)
+	fmm.attributes.dropScope(transferAttributesBucket, key)
+	if orphan {
+		fmm.attributes.dropScope(fileAttributesBucket, sourcePath)
+	}
 	return nil
 }
 
+// Attributes returns the attributes scoped to the transfer of the file of the given source path to the server of the view.
+func (fmm *fileMetadataMap) Attributes(sourcePath string) AttributesMap {
+	return fmm.attributes.transfer(fileKey(fmm.server, sourcePath))
+}
+
+// shared returns whether the source path is also transferred to another server than the file of the given key,
+// the scoped attributes of the file are then kept.
+func (fmm *fileMetadataMap) shared(key string, sourcePath string) bool {
+	shared := false
+	fmm.m.Range(func(k, value any) bool {
+		shared = k.(string) != key && value.(FileMetadata).SourcePath == sourcePath
+		return !shared
+	})
+	return shared
+}
+
+// Server returns the view of the files transferred to the server profile of the given name.
+func (fmm *fileMetadataMap) Server(name string) FileMetadataMap {
+	if name == DefaultServer {
+		name = ""
+	}
+	view := *fmm
+	view.server = name
+	return &view
+}
+
+// owns returns whether the file metadata belongs to the server of the view.
+func (fmm *fileMetadataMap) owns(meta FileMetadata) bool {
+	return meta.Server == fmm.server
+}
+
+// All returns the file metadata of every server, whatever the server of the view.
+func (fmm *fileMetadataMap) All() []FileMetadata {
+	var files []FileMetadata
+	fmm.m.Range(func(key, value any) bool {
+		files = append(files, value.(FileMetadata))
+		return true
+	})
+	return files
+}
+
 // sync synchronizes the file metadata in the database with the file metadata in the TransferManager's files map.
 func (fmm *fileMetadataMap) sync() error {
 	fmm.m.Range(func(key, value any) bool {
@@ -159,22 +339,63 @@ func (fmm *fileMetadataMap) sync() error {
 }
 
 // Operate executes the given operation on each file metadata in the map.
+// A completed file must be Reset to be transferred again: when one is found, ErrInvalidTransition
+// is returned before any file is transferred.
+// Once the TransferManager context is cancelled no new transfers are started, see OperateContext.
 func (fmm *fileMetadataMap) Operate(transfer Transfer) ([]FileMetadata, error) {
+	return fmm.OperateContext(func(_ context.Context, sourcePath string, targetPath string) (int, error) {
+		return transfer(sourcePath, targetPath)
+	})
+}
+
+// OperateContext executes the given operation on each file metadata in the map.
+// Like Operate, ErrInvalidTransition is returned before any transfer when a file is completed.
+// A failed transfer is retried according to the retry policy of the TransferManager.
+// The TransferManager context is handed to the transfer. Once the context is cancelled no new transfers
+// are started, a transfer that fails after the cancellation is marked as StatusInterrupted so it can be
+// resumed later, and the files that were not reached keep their status. In that case the database is
+// synced and the file metadata is returned together with the context error.
+func (fmm *fileMetadataMap) OperateContext(transfer ContextTransfer) ([]FileMetadata, error) {
+	return fmm.OperateProgress(func(ctx context.Context, sourcePath string, targetPath string, _ *Progress) (int, error) {
+		return transfer(ctx, sourcePath, targetPath)
+	})
+}
+
+// OperateProgress executes the given operation on each file metadata in the map like OperateContext.
+// A progress reporter is handed to the transfer so BytesTransferred is updated while the file is
+// transferred, every attempt reports its progress from 0.
+func (fmm *fileMetadataMap) OperateProgress(transfer ProgressTransfer) ([]FileMetadata, error) {
+	if err := fmm.checkCompleted(); err != nil {
+		return nil, err
+	}
 
-	var errGeneral error
+	var errGeneral, errCtx error
 	fmm.m.Range(func(key, value any) bool {
+		if errCtx = fmm.ctx.Err(); errCtx != nil {
+			return false
+		}
+
 		meta := value.(FileMetadata)
+		if !fmm.owns(meta) {
+			return true
+		}
 
 		errGeneral = fmm.UpdateStatus(meta.SourcePath, StatusInProgress, 0, nil)
 		if errGeneral != nil {
 			return false
 		}
 
-		n, err := transfer(meta.SourcePath, meta.TargetPath)
-		if err != nil {
-			errGeneral = fmm.UpdateStatus(meta.SourcePath, StatusFailed, n, err)
-		} else {
-			errGeneral = fmm.UpdateStatus(meta.SourcePath, StatusCompleted, n, nil)
+		n, attempts, err := fmm.attempt(fmm.ctx, meta.SourcePath, func() (int, error) {
+			return transfer(fmm.ctx, meta.SourcePath, meta.TargetPath, &Progress{fmm: fmm, sourcePath: meta.SourcePath})
+		})
+
+		switch {
+		case err != nil && fmm.ctx.Err() != nil:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusInterrupted, n, err, attempts)
+		case err != nil:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusFailed, n, err, attempts)
+		default:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusCompleted, n, nil, attempts)
 		}
 
 		if errGeneral != nil {
@@ -192,15 +413,243 @@ func (fmm *fileMetadataMap) Operate(transfer Transfer) ([]FileMetadata, error) {
 		return nil, err
 	}
 
-	return fmm.GetSlice()
+	files, err := fmm.GetSlice()
+	if err != nil {
+		return nil, err
+	}
 
+	return files, errCtx
+}
+
+// OperateConcurrent executes the given operation on each file metadata in the map using a pool of workers,
+// see OperateConcurrentContext.
+func (fmm *fileMetadataMap) OperateConcurrent(ctx context.Context, transfer Transfer, workers int) ([]TransferResult, error) {
+	return fmm.OperateConcurrentContext(ctx, func(_ context.Context, sourcePath string, targetPath string) (int, error) {
+		return transfer(sourcePath, targetPath)
+	}, workers)
+}
+
+// OperateConcurrentContext executes the given operation on each file metadata in the map using a pool of workers.
+// Like Operate, ErrInvalidTransition is returned before any transfer when a file is completed.
+// The status transitions are the same as in OperateContext, the writes to the database are serialized.
+// The transfers are handed a context cancelled with ctx and with the TransferManager context.
+// Once it is cancelled, or a status update fails, no new transfers are started; the transfers already
+// running are allowed to finish and a transfer that fails after the cancellation is marked as
+// StatusInterrupted. The result of every file that was processed is returned, together
+// with the first bookkeeping error or the context error.
+func (fmm *fileMetadataMap) OperateConcurrentContext(ctx context.Context, transfer ContextTransfer, workers int) ([]TransferResult, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if err := fmm.checkCompleted(); err != nil {
+		return nil, err
+	}
+
+	var files []FileMetadata
+	fmm.m.Range(func(key, value any) bool {
+		if meta := value.(FileMetadata); fmm.owns(meta) {
+			files = append(files, meta)
+		}
+		return true
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-fmm.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var (
+		wg         sync.WaitGroup
+		errOnce    sync.Once
+		errGeneral error
+		jobs       = make(chan int)
+		results    = make([]TransferResult, len(files))
+		processed  = make([]bool, len(files))
+	)
+
+	fail := func(err error) {
+		errOnce.Do(func() {
+			errGeneral = err
+			cancel()
+		})
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// The dispatch may pick a job over the cancellation
+				if ctx.Err() != nil {
+					continue
+				}
+				results[i], processed[i] = fmm.operateFile(ctx, files[i], transfer, fail), true
+			}
+		}()
+	}
+
+dispatch:
+	for i := range files {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	done := make([]TransferResult, 0, len(files))
+	for i, ok := range processed {
+		if ok {
+			done = append(done, results[i])
+		}
+	}
+
+	if errGeneral == nil && len(done) < len(files) {
+		errGeneral = ctx.Err()
+	}
+
+	if err := fmm.db.Sync(); err != nil && errGeneral == nil {
+		errGeneral = err
+	}
+
+	return done, errGeneral
+}
+
+// checkCompleted returns ErrInvalidTransition when a file of the view is completed,
+// as it cannot be transferred again until it is Reset.
+func (fmm *fileMetadataMap) checkCompleted() error {
+	var err error
+	fmm.m.Range(func(key, value any) bool {
+		if meta := value.(FileMetadata); meta.Status == StatusCompleted && fmm.owns(meta) {
+			err = errors.Wrapf(ErrInvalidTransition, "'%s' from %s to %s, it must be Reset first",
+				meta.SourcePath, StatusCompleted, StatusInProgress)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// operateFile executes the transfer of a single file and records the status transitions.
+// Bookkeeping errors are reported to fail.
+func (fmm *fileMetadataMap) operateFile(ctx context.Context, meta FileMetadata, transfer ContextTransfer, fail func(error)) TransferResult {
+	if err := fmm.UpdateStatus(meta.SourcePath, StatusInProgress, 0, nil); err != nil {
+		fail(err)
+		return TransferResult{Metadata: meta, Err: err}
+	}
+
+	n, attempts, errTransfer := fmm.attempt(ctx, meta.SourcePath, func() (int, error) {
+		return transfer(ctx, meta.SourcePath, meta.TargetPath)
+	})
+
+	var err error
+	switch {
+	case errTransfer != nil && ctx.Err() != nil:
+		err = fmm.updateStatus(meta.SourcePath, StatusInterrupted, n, errTransfer, attempts)
+	case errTransfer != nil:
+		err = fmm.updateStatus(meta.SourcePath, StatusFailed, n, errTransfer, attempts)
+	default:
+		err = fmm.updateStatus(meta.SourcePath, StatusCompleted, n, nil, attempts)
+	}
+
+	if err != nil {
+		fail(err)
+		errTransfer = err
+	}
+
+	meta, _ = fmm.Load(meta.SourcePath)
+	return TransferResult{Metadata: meta, Err: errTransfer}
+}
+
+// Resume executes the given operation on each file metadata in the map that has not been completed yet.
+// Completed files are skipped. Files that are not started, failed, interrupted or left in progress by a previous run
+// are transferred again; the recorded BytesTransferred is kept and handed to the transfer as the offset
+// to continue from, and the bytes transferred by the call are added to it. A retried attempt continues
+// from the bytes transferred by the previous attempts.
+// Like OperateContext, no new transfers are started once the TransferManager context is cancelled,
+// see ResumeContext.
+func (fmm *fileMetadataMap) Resume(transfer ResumableTransfer) ([]FileMetadata, error) {
+	return fmm.ResumeContext(func(_ context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+		return transfer(sourcePath, targetPath, offset)
+	})
+}
+
+// ResumeContext executes the given operation on each file metadata in the map that has not been completed yet
+// like Resume. The TransferManager context is handed to the transfer. Like OperateContext, once the context is
+// cancelled no new transfers are started and a transfer that fails after the cancellation is marked as
+// StatusInterrupted, with the offset reached, so it can be resumed later.
+func (fmm *fileMetadataMap) ResumeContext(transfer ResumableContextTransfer) ([]FileMetadata, error) {
+
+	var errGeneral, errCtx error
+	fmm.m.Range(func(key, value any) bool {
+		if errCtx = fmm.ctx.Err(); errCtx != nil {
+			return false
+		}
+
+		meta := value.(FileMetadata)
+		if meta.Status == StatusCompleted || !fmm.owns(meta) {
+			return true
+		}
+
+		offset := meta.BytesTransferred
+		errGeneral = fmm.UpdateStatus(meta.SourcePath, StatusInProgress, offset, nil)
+		if errGeneral != nil {
+			return false
+		}
+
+		_, attempts, err := fmm.attempt(fmm.ctx, meta.SourcePath, func() (int, error) {
+			n, err := transfer(fmm.ctx, meta.SourcePath, meta.TargetPath, offset)
+			offset += n
+			return n, err
+		})
+
+		switch {
+		case err != nil && fmm.ctx.Err() != nil:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusInterrupted, offset, err, attempts)
+		case err != nil:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusFailed, offset, err, attempts)
+		default:
+			errGeneral = fmm.updateStatus(meta.SourcePath, StatusCompleted, offset, nil, attempts)
+		}
+
+		if errGeneral != nil {
+			return false
+		}
+
+		return true
+	})
+
+	if errGeneral != nil {
+		return nil, errGeneral
+	}
+
+	if err := fmm.sync(); err != nil {
+		return nil, err
+	}
+
+	files, err := fmm.GetSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	return files, errCtx
 }
 
 // GetSlice returns a slice of file metadata
 func (fmm *fileMetadataMap) GetSlice() ([]FileMetadata, error) {
 	files := make([]FileMetadata, 0)
 	fmm.m.Range(func(key, value any) bool {
-		files = append(files, value.(FileMetadata))
+		if meta := value.(FileMetadata); fmm.owns(meta) {
+			files = append(files, meta)
+		}
 		return true
 	})
 	if len(files) == 0 {
@@ -210,23 +659,54 @@ func (fmm *fileMetadataMap) GetSlice() ([]FileMetadata, error) {
 }
 
 // UpdateStatus updates the status of the file metadata for the given source path.
+// The transition must be allowed by CanTransition, otherwise ErrInvalidTransition is returned.
+// The error message is only kept by the failed and interrupted statuses, starting a transfer clears the end time.
+// Every update is appended to the history of the file.
 func (fmm *fileMetadataMap) UpdateStatus(sourcePath string, status TransferStatus, bytesTransferred int, err error) error {
+	return fmm.updateStatus(sourcePath, status, bytesTransferred, err, 0)
+}
+
+// updateStatus updates the status like UpdateStatus. The final status of a transfer is recorded as its last
+// attempt, the failed attempts before it are recorded by recordAttempt; attempt is 0 outside a transfer.
+// Starting a transfer discards the attempts of the previous one.
+func (fmm *fileMetadataMap) updateStatus(sourcePath string, status TransferStatus, bytesTransferred int, err error, attempt int) error {
+	// Deferred first so the subscribers are notified once the lock is released.
+	defer fmm.progress.notify(fmm)
+
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
 	meta, ok := fmm.Load(sourcePath)
 	if !ok {
 		return errors.Errorf("'%s' file key not found in map", sourcePath)
 	}
-	meta.Status = status
-	meta.BytesTransferred = bytesTransferred
-	if err != nil {
-		meta.ErrorMsg = err.Error()
+	meta, errTransition := meta.transition(status, bytesTransferred, err)
+	if errTransition != nil {
+		return errTransition
 	}
-	if status == StatusInProgress {
-		meta.TimeStart = time.Now()
-	} else if status == StatusCompleted || status == StatusFailed {
-		meta.TimeEnd = time.Now()
+	meta.RunID = fmm.runID
+	if attempt > 0 {
+		meta.Attempts = attempt
 	}
 
-	return fmm.StoreOrUpdate(meta)
+	errUpdate := fmm.db.Update(func(tx Tx) error {
+		if err := fmm.putFile(tx, meta); err != nil {
+			return err
+		}
+		if status == StatusInProgress {
+			if err := deleteAttempts(tx, meta.key()); err != nil {
+				return err
+			}
+		}
+		return fmm.appendHistory(tx, meta, attempt)
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+	fmm.m.Store(meta.key(), meta)
+	fmm.progress.transition(status)
+
+	return nil
 }
 
 // Start starts the transfer for the given source path.
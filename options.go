@@ -0,0 +1,218 @@
+package reflux
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultFileMode = 0600        // The default permissions of the lock file
+	defaultTimeout  = time.Second // The default amount of time to wait to obtain the file lock
+)
+
+// options holds the configuration used by NewTransferManager.
+type options struct {
+	lockFilePath      string          // The path of the lock file, takes precedence over lockDir
+	lockDir           string          // The directory where the default lock file name is created
+	fileMode          os.FileMode     // The permissions used when creating the lock file
+	timeout           time.Duration   // The amount of time to wait to obtain the file lock, 0 waits forever
+	lockTakeover      bool            // Whether a lock file recorded as held by a running process is taken over
+	strictLock        bool            // Whether a lock file recorded as held by a process on another host is refused
+	signalHandling    bool            // Whether SIGINT and SIGTERM cancel the manager context
+	ctx               context.Context // The parent context of the manager
+	retryPolicy       RetryPolicy     // The policy applied when a transfer fails
+	progressInterval  time.Duration   // The minimum time between two writes of the progress to the database
+	changeDetection   bool            // Whether files whose source changed since the previous run are reset
+	checksumDetection bool            // Whether the change detection hashes the sources with a checksum again
+	historyRetention  int             // The maximum number of history records kept per file, 0 keeps all
+	store             Store           // The storage backend, the BoltDB lock file if nil
+	codec             Codec           // The codec used to write the records
+	migrations        []Migration     // The migrations applied to the records older than SchemaVersion
+	resolver          Resolver        // Resolves the hostnames of the stored servers, nil skips the resolution
+	keys              KeyProvider     // Supplies the keys encrypting the records, nil writes them in plain
+}
+
+// Option configures a TransferManager created by NewTransferManager.
+type Option func(*options)
+
+// defaultOptions returns the options used when NewTransferManager is called without arguments.
+func defaultOptions() *options {
+	return &options{
+		lockDir:          ".",
+		fileMode:         defaultFileMode,
+		timeout:          defaultTimeout,
+		signalHandling:   true,
+		ctx:              context.Background(),
+		progressInterval: defaultProgressInterval,
+		changeDetection:  true,
+		codec:            GobCodec(),
+	}
+}
+
+// path returns the lock file path resolved from the options.
+// If no explicit path was given, the lock file is named after the running binary and placed in lockDir.
+func (o *options) path() string {
+	if o.lockFilePath != "" {
+		return o.lockFilePath
+	}
+	return filepath.Join(o.lockDir, "."+filepath.Base(os.Args[0])+".lock")
+}
+
+// WithLockFile sets the full path of the lock file.
+// It takes precedence over WithLockDir.
+func WithLockFile(path string) Option {
+	return func(o *options) {
+		o.lockFilePath = path
+	}
+}
+
+// WithLockDir sets the directory where the lock file is created.
+// The lock file keeps its default name, derived from the name of the running binary.
+func WithLockDir(dir string) Option {
+	return func(o *options) {
+		o.lockDir = dir
+	}
+}
+
+// WithFileMode sets the permissions used when the lock file is created.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode
+	}
+}
+
+// WithTimeout sets the amount of time to wait to obtain the lock on the lock file before
+// NewTransferManager returns a *LockedError. The default is one second, a zero timeout waits indefinitely.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithLockTakeover forces the takeover of a lock file recorded as held by a process that may still be running:
+// a process of this host that is running, or a process of another host with WithStrictLock.
+// It must only be enabled once the holder is known to be stopped. The holder is returned by PreviousHolder.
+func WithLockTakeover(enabled bool) Option {
+	return func(o *options) {
+		o.lockTakeover = enabled
+	}
+}
+
+// WithStrictLock enables or disables the refusal of a lock file recorded as held by a process on another host,
+// whose liveness cannot be checked. It is disabled by default: the file lock already excludes a running holder,
+// so the holder of another host stopped, such as a job restarted in a new container, and its lock is taken over.
+// Enable it for a lock file shared by several hosts on a filesystem that does not enforce the file lock, such as
+// NFS: NewTransferManager then returns a *LockedError until the takeover is forced with WithLockTakeover.
+func WithStrictLock(enabled bool) Option {
+	return func(o *options) {
+		o.strictLock = enabled
+	}
+}
+
+// WithSignalHandling enables or disables the cancellation of the manager context on SIGINT and SIGTERM.
+// Signal handling is enabled by default.
+func WithSignalHandling(enabled bool) Option {
+	return func(o *options) {
+		o.signalHandling = enabled
+	}
+}
+
+// WithContext sets the parent context of the TransferManager.
+// Cancelling the parent context cancels the manager context.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		if ctx != nil {
+			o.ctx = ctx
+		}
+	}
+}
+
+// WithRetryPolicy sets the policy applied by the Operate methods when a transfer fails.
+// By default a failed transfer is not retried.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithProgressInterval sets the minimum time between two writes to the lock file of the progress
+// reported by an in-flight transfer. The progress is always visible through Files.Load.
+// The default interval is one second.
+func WithProgressInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.progressInterval = interval
+	}
+}
+
+// WithChangeDetection enables or disables the reset of the files whose source changed since the previous run.
+// When enabled, the default, the fingerprint recorded by NewFileMetadata is compared with the source file
+// once the lock file is loaded and the changed files not completed are reset to StatusNotStarted, the completed
+// ones are only reported, see Invalidated.
+func WithChangeDetection(enabled bool) Option {
+	return func(o *options) {
+		o.changeDetection = enabled
+	}
+}
+
+// WithChecksumDetection enables or disables the comparison of the checksum recorded in the fingerprint,
+// which reads the whole source file of every file not completed when the lock file is loaded.
+// It is disabled by default, only the size, the modification time and the inode are compared.
+func WithChecksumDetection(enabled bool) Option {
+	return func(o *options) {
+		o.checksumDetection = enabled
+	}
+}
+
+// WithHistoryRetention sets the maximum number of history records kept per file, the oldest records are
+// removed first. By default the whole history is kept.
+func WithHistoryRetention(records int) Option {
+	return func(o *options) {
+		o.historyRetention = records
+	}
+}
+
+// WithStore sets the storage backend of the TransferManager instead of the BoltDB lock file.
+// The lock file options are ignored. The store belongs to the caller: Close and Finish do not close it
+// nor delete its content, so it can be handed to another TransferManager to resume the transfers.
+func WithStore(store Store) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithCodec sets the codec used to write the records, GobCodec by default.
+// The records are read whatever built-in codec wrote them, so the codec of an existing lock file can be
+// changed: its records are written again with the new codec when it is loaded.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithMigrations sets the migrations applied, in order, to the records older than SchemaVersion when an
+// existing lock file is loaded. The migrated records are written back in the current schema.
+func WithMigrations(migrations ...Migration) Option {
+	return func(o *options) {
+		o.migrations = append(o.migrations, migrations...)
+	}
+}
+
+// WithResolver sets the resolver checking that the hostname of a server is resolved when it is stored with
+// StoreServer or StoreOrUpdateServerInfo. By default the server info is only validated syntactically, so it
+// can be recorded without network access.
+func WithResolver(resolver Resolver) Option {
+	return func(o *options) {
+		o.resolver = resolver
+	}
+}
+
+// WithEncryption encrypts the records at rest with AES-GCM, using the keys supplied by the provider.
+// The records written without encryption are encrypted when the lock file is loaded, a record encrypted with
+// a key the provider does not supply returns an error matching ErrWrongKey. The lock holder is not encrypted.
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
@@ -0,0 +1,205 @@
+package reflux
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProgressInterval = time.Second // The default minimum time between two writes of the progress to the database
+	progressBufferSize      = 1           // The buffer of the subscription channels, only the latest report matters
+)
+
+// Progress reports the bytes transferred by an in-flight transfer.
+// It implements io.Writer so it can be combined with io.TeeReader or io.MultiWriter.
+// BytesTransferred is updated on every report, the database is written at most once per progress interval.
+type Progress struct {
+	fmm        *fileMetadataMap
+	sourcePath string
+	mu         sync.Mutex
+	bytes      int       // The bytes transferred, including the offset the transfer started from
+	persisted  time.Time // The last time the progress was written to the database
+}
+
+// Add adds n bytes to the bytes transferred.
+func (p *Progress) Add(n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytes += n
+	persist := time.Since(p.persisted) >= p.fmm.progressInterval
+	if persist {
+		p.persisted = time.Now()
+	}
+	return p.fmm.setProgress(p.sourcePath, p.bytes, persist)
+}
+
+// Write adds the length of b to the bytes transferred.
+// An error is returned only if the progress cannot be recorded.
+func (p *Progress) Write(b []byte) (int, error) {
+	if err := p.Add(len(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Bytes returns the bytes transferred so far.
+func (p *Progress) Bytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes
+}
+
+// ProgressReport is an aggregate snapshot of the transfers managed by a TransferManager.
+type ProgressReport struct {
+	FilesTotal       int           // The number of registered files
+	FilesDone        int           // The number of completed files
+	FilesFailed      int           // The number of failed files
+	BytesTransferred int           // The sum of the bytes transferred of every file
+	Elapsed          time.Duration // The time since the first transfer of the session started
+	ETA              time.Duration // The estimated time to complete the remaining files, 0 if unknown
+}
+
+// progressHub publishes progress reports to the subscribers.
+type progressHub struct {
+	mu          sync.Mutex
+	subscribers map[chan ProgressReport]struct{}
+	start       time.Time // The time the first transfer of the session started
+	completed   int       // The number of files completed during the session
+	closed      bool
+}
+
+// newProgressHub returns a progress hub without subscribers.
+func newProgressHub() *progressHub {
+	return &progressHub{
+		subscribers: make(map[chan ProgressReport]struct{}),
+	}
+}
+
+// subscribe returns a channel receiving the progress reports and the function to cancel the subscription.
+func (h *progressHub) subscribe() (<-chan ProgressReport, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan ProgressReport, progressBufferSize)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// transition records a status change used to estimate the remaining time.
+func (h *progressHub) transition(status TransferStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch status {
+	case StatusInProgress:
+		if h.start.IsZero() {
+			h.start = time.Now()
+		}
+	case StatusCompleted:
+		h.completed++
+	}
+}
+
+// notify publishes the current progress of the files to the subscribers.
+// Slow subscribers miss the intermediate reports, they always receive the latest one.
+func (h *progressHub) notify(fmm *fileMetadataMap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	var report ProgressReport
+	fmm.m.Range(func(key, value any) bool {
+		meta := value.(FileMetadata)
+		report.FilesTotal++
+		report.BytesTransferred += meta.BytesTransferred
+		switch meta.Status {
+		case StatusCompleted:
+			report.FilesDone++
+		case StatusFailed:
+			report.FilesFailed++
+		}
+		return true
+	})
+
+	if !h.start.IsZero() {
+		report.Elapsed = time.Since(h.start)
+		if h.completed > 0 {
+			remaining := report.FilesTotal - report.FilesDone
+			report.ETA = report.Elapsed / time.Duration(h.completed) * time.Duration(remaining)
+		}
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- report:
+		default:
+			// Replace the stale report.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- report
+		}
+	}
+}
+
+// close closes the channels of every subscriber.
+func (h *progressHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	h.closed = true
+}
+
+// setProgress sets the bytes transferred of the file metadata for the given source path.
+// The map is always updated, the database only when persist is true.
+func (fmm *fileMetadataMap) setProgress(sourcePath string, bytesTransferred int, persist bool) error {
+	fmm.mu.Lock()
+	meta, ok := fmm.Load(sourcePath)
+	if !ok {
+		fmm.mu.Unlock()
+		return errors.Errorf("'%s' file key not found in map", sourcePath)
+	}
+
+	meta.BytesTransferred = bytesTransferred
+	var err error
+	if persist {
+		err = fmm.StoreOrUpdate(meta)
+	} else {
+		fmm.m.Store(meta.key(), meta)
+	}
+	fmm.mu.Unlock()
+
+	if persist && err == nil {
+		fmm.progress.notify(fmm)
+	}
+	return err
+}
+
+// SubscribeProgress returns a channel receiving an aggregate progress report every time the status of a file
+// changes or the progress of a transfer is written to the database, and the function to cancel the subscription.
+// The channel is closed when the subscription is cancelled or the TransferManager is closed.
+func (tm *TransferManager) SubscribeProgress() (<-chan ProgressReport, func()) {
+	return tm.progress.subscribe()
+}
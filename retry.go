@@ -0,0 +1,127 @@
+package reflux
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffMultiplier = 2 // The growth factor of the backoff when RetryPolicy.Multiplier is not set
+)
+
+// RetryPolicy defines how the transfer of a file is retried when it fails.
+// The zero value performs a single attempt.
+type RetryPolicy struct {
+	MaxAttempts    int              // The maximum number of attempts per file, values lower than 2 disable the retries
+	InitialBackoff time.Duration    // The time to wait before the first retry
+	MaxBackoff     time.Duration    // The upper bound of the time to wait between attempts, 0 means no bound
+	Multiplier     float64          // The growth factor of the backoff after each attempt, 2 if not set
+	Jitter         float64          // The fraction, between 0 and 1, of the backoff that is randomized
+	Retryable      func(error) bool // Whether the error returned by the transfer can be retried, all errors if nil
+}
+
+// retryable returns whether a new attempt should follow the given failed attempt.
+func (rp RetryPolicy) retryable(attempt int, err error) bool {
+	if attempt >= rp.MaxAttempts {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return rp.Retryable == nil || rp.Retryable(err)
+}
+
+// backoff returns the time to wait after the given failed attempt.
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier <= 0 {
+		multiplier = defaultBackoffMultiplier
+	}
+
+	backoff := float64(rp.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= multiplier
+		if rp.MaxBackoff > 0 && backoff > float64(rp.MaxBackoff) {
+			break
+		}
+	}
+	if rp.MaxBackoff > 0 && backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+
+	if rp.Jitter > 0 {
+		jitter := rp.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff -= backoff * jitter * rand.Float64()
+	}
+
+	return time.Duration(backoff)
+}
+
+// wait blocks for the backoff of the given failed attempt or until ctx is cancelled.
+func (rp RetryPolicy) wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(rp.backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// attempt executes the transfer of the given source path following the retry policy.
+// It returns the result and the number of the last attempt. Each failed attempt that is retried is recorded
+// as soon as it ends, see recordAttempt, the last one is recorded along with the final status of the file.
+// A failure to record an attempt stops the retries and is returned as the error.
+func (fmm *fileMetadataMap) attempt(ctx context.Context, sourcePath string, transfer func() (int, error)) (n int, attempt int, err error) {
+	for attempt = 1; ; attempt++ {
+		n, err = transfer()
+		if err == nil || !fmm.retryPolicy.retryable(attempt, err) {
+			return n, attempt, err
+		}
+
+		if errRecord := fmm.recordAttempt(sourcePath, attempt, err); errRecord != nil {
+			return n, attempt, errors.Wrapf(errRecord, "failed to record attempt %d", attempt)
+		}
+
+		if fmm.retryPolicy.wait(ctx, attempt) != nil {
+			return n, attempt, err
+		}
+	}
+}
+
+// recordAttempt records the given failed attempt of the transfer of sourcePath, which is retried:
+// the file keeps the count of attempts and the attempt is recorded with StatusFailed and its error.
+func (fmm *fileMetadataMap) recordAttempt(sourcePath string, attempt int, err error) error {
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
+	meta, ok := fmm.Load(sourcePath)
+	if !ok {
+		return errors.Errorf("'%s' file key not found in map", sourcePath)
+	}
+	meta.Attempts = attempt
+	meta.RunID = fmm.runID
+
+	errUpdate := fmm.db.Update(func(tx Tx) error {
+		if err := fmm.putFile(tx, meta); err != nil {
+			return err
+		}
+		failed := meta
+		failed.Status = StatusFailed
+		failed.ErrorMsg = err.Error()
+		return fmm.appendHistory(tx, failed, attempt)
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+	fmm.m.Store(meta.key(), meta)
+
+	return nil
+}
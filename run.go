@@ -0,0 +1,184 @@
+package reflux
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	runIDSize = 8 // The number of random bytes of a run ID
+)
+
+// ExitReason describes how a run of the TransferManager ended.
+type ExitReason string
+
+const (
+	ExitRunning ExitReason = ""       // The run has not ended
+	ExitClose   ExitReason = "close"  // The TransferManager was closed
+	ExitFinish  ExitReason = "finish" // The TransferManager was finished
+	ExitSignal  ExitReason = "signal" // The TransferManager was closed after a handled signal was received
+	ExitCrash   ExitReason = "crash"  // The process stopped without closing the TransferManager
+)
+
+// Run describes a session of a TransferManager on a lock file.
+type Run struct {
+	ID         string     // The random ID of the run
+	PID        int        // The process ID
+	Hostname   string     // The hostname of the machine running the process
+	Args       []string   // The command line arguments of the process
+	Started    time.Time  // The time the TransferManager was created
+	Stopped    time.Time  // The time the TransferManager was closed, zero if it was not
+	ExitReason ExitReason // How the run ended
+	Signal     string     // The signal received, when ExitReason is ExitSignal
+}
+
+// newRunID returns a random ID identifying a run of the TransferManager.
+func newRunID() (string, error) {
+	id := make([]byte, runIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// putRun encodes the run and stores it in the runs bucket.
+func (tm *TransferManager) putRun(tx Tx, run Run) error {
+	b, err := tx.CreateBucketIfNotExists(runsBucket.Bytes())
+	if err != nil {
+		return err
+	}
+
+	record, err := tm.serializer.encode(run)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(run.ID), record)
+}
+
+// forEachRun calls fn for every run recorded in the runs bucket.
+func (tm *TransferManager) forEachRun(tx Tx, fn func(run Run) error) error {
+	b := tx.Bucket(runsBucket.Bytes())
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		var run Run
+		if _, err := tm.serializer.load(runsBucket, k, v, &run); err != nil {
+			return err
+		}
+		return fn(run)
+	})
+}
+
+// startRun records the current run. The previous runs that never ended are marked as crashed,
+// the stale records of the runs are written again.
+func (tm *TransferManager) startRun() error {
+	hostname, _ := os.Hostname()
+	run := Run{
+		ID:       tm.runID,
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Args:     os.Args,
+		Started:  time.Now(),
+	}
+
+	return tm.db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(runsBucket.Bytes())
+		if err != nil {
+			return err
+		}
+
+		var crashed []Run
+		err = loadRecords(tm.serializer, b, runsBucket, func(_ []byte, previous Run) error {
+			if previous.ExitReason == ExitRunning {
+				previous.ExitReason = ExitCrash
+				crashed = append(crashed, previous)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, previous := range crashed {
+			if err := tm.putRun(tx, previous); err != nil {
+				return err
+			}
+		}
+
+		return tm.putRun(tx, run)
+	})
+}
+
+// stopRun records the end of the current run with the given reason.
+// A handled signal received before takes precedence over reason.
+func (tm *TransferManager) stopRun(reason ExitReason) error {
+	tm.mu.Lock()
+	sig := tm.signal
+	tm.mu.Unlock()
+
+	return tm.db.Update(func(tx Tx) error {
+		b := tx.Bucket(runsBucket.Bytes())
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(tm.runID))
+		if v == nil {
+			return nil
+		}
+
+		var run Run
+		if _, err := tm.serializer.load(runsBucket, []byte(tm.runID), v, &run); err != nil {
+			return err
+		}
+
+		run.Stopped = time.Now()
+		run.ExitReason = reason
+		if sig != nil {
+			run.ExitReason = ExitSignal
+			run.Signal = sig.String()
+		}
+		return tm.putRun(tx, run)
+	})
+}
+
+// RunID returns the ID of the current run, recorded in the file metadata and the history of the files.
+func (tm *TransferManager) RunID() string {
+	return tm.runID
+}
+
+// Runs returns every run recorded in the lock file, oldest first.
+// The runs that stopped without closing the TransferManager have ExitCrash as exit reason.
+func (tm *TransferManager) Runs() ([]Run, error) {
+	var runs []Run
+	err := tm.db.View(func(tx Tx) error {
+		return tm.forEachRun(tx, func(run Run) error {
+			runs = append(runs, run)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.Before(runs[j].Started)
+	})
+	return runs, nil
+}
+
+// FilesByRun returns the file metadata of every server whose last status update was recorded by the given run.
+func (tm *TransferManager) FilesByRun(runID string) []FileMetadata {
+	var files []FileMetadata
+	for _, meta := range tm.Files.All() {
+		if meta.RunID == runID {
+			files = append(files, meta)
+		}
+	}
+	return files
+}
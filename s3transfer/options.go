@@ -0,0 +1,62 @@
+package s3transfer
+
+import (
+	"gopkg.in/ro-ag/reflux.v0"
+	"net/http"
+)
+
+const defaultPartSize = 8 << 20 // The size of the parts of the uploads by default
+
+// CredentialFunc returns the secret access key kept under the given ID in a credential store. It resolves the
+// servers authenticated with reflux.AuthCredential, the User of the server being the access key ID.
+type CredentialFunc func(id string) (string, error)
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	client      *http.Client   // The HTTP client sending the requests, nil for one built from the server info
+	partSize    int64          // The size of the parts of the new uploads
+	credentials CredentialFunc // Resolves the credential IDs, nil if no credential store is used
+	server      string         // The server profile of the files uploaded, reflux.DefaultServer by default
+}
+
+// defaultOptions returns the options of a Client.
+func defaultOptions() *options {
+	return &options{
+		partSize: defaultPartSize,
+		server:   reflux.DefaultServer,
+	}
+}
+
+// WithHTTPClient sets the HTTP client sending the requests. The timeouts of the server info are then ignored.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithPartSize sets the size of the parts of the new uploads, 8 MiB by default. S3 requires at least 5 MiB
+// for every part but the last, and at most 10000 parts: the size is raised for the larger files.
+// The uploads already started keep the size they were started with.
+func WithPartSize(size int64) Option {
+	return func(o *options) {
+		o.partSize = size
+	}
+}
+
+// WithCredentials sets the resolver of the credential IDs of the servers authenticated with reflux.AuthCredential.
+func WithCredentials(credentials CredentialFunc) Option {
+	return func(o *options) {
+		o.credentials = credentials
+	}
+}
+
+// WithServer sets the server profile the files are uploaded to, reflux.DefaultServer by default.
+// FromManager reads the profile and the uploads are kept in the transfer attributes of its files,
+// so the same file is resumed correctly on each server.
+func WithServer(name string) Option {
+	return func(o *options) {
+		o.server = name
+	}
+}
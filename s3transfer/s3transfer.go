@@ -0,0 +1,561 @@
+// Package s3transfer provides the uploads of a TransferManager to an S3 compatible object storage.
+//
+// The Client uploads the files with multipart uploads. The upload ID and the completed parts are stored in the
+// transfer attributes of the file, see reflux.FileMetadataMap.Attributes, as soon as they are known, so an upload
+// interrupted by a crash is resumed from the missing parts. Each server keeps its own uploads. Client.Reset aborts
+// the upload of a file, the uploads of the files deleted with FileMetadataMap.Delete are aborted by AbortOrphans.
+//
+// The bucket is the first element of the BaseDir of the server, the rest is the prefix of the object keys.
+// The requests are signed with the AWS signature version 4 when the server uses reflux.AuthCredential.
+//
+// Example:
+//
+//	client, err := s3transfer.FromManager(tm, s3transfer.WithCredentials(secrets.Lookup))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	results, err := tm.Files.OperateConcurrent(ctx, client.Upload, 4)
+package s3transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"github.com/pkg/errors"
+	"gopkg.in/ro-ag/reflux.v0"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UploadAttr = "s3.upload" // The transfer attribute of the file holding its Upload
+
+	RegionOption = "region" // The server option holding the region of the bucket, DefaultRegion if not set
+	TLSOption    = "tls"    // The server option disabling HTTPS when set to "false", for the local servers
+
+	DefaultRegion = "us-east-1"
+
+	maxParts     = 10000    // The maximum number of parts of an upload
+	maxErrorBody = 64 << 10 // The maximum size of the error responses read
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("server scheme is not s3")
+	ErrUnsupportedAuth   = errors.New("auth method not supported over S3")
+	ErrNoCredentials     = errors.New("no credential resolver set")
+	ErrNoBucket          = errors.New("no bucket in the server base directory")
+	ErrNoSuchUpload      = errors.New("multipart upload not found")
+	ErrUnexpectedStatus  = errors.New("unexpected S3 response")
+)
+
+// Upload is the multipart upload of a file, stored in the transfer attributes of the file under UploadAttr until
+// it is complete. The upload is resumed only if the source still has the recorded size and modification time.
+type Upload struct {
+	ID       string    // The upload ID returned by the server
+	Key      string    // The key of the object
+	Size     int64     // The size of the source
+	ModTime  time.Time // The modification time of the source
+	PartSize int64     // The size of the parts, the last one may be smaller
+	Parts    []Part    // The completed parts
+}
+
+// Part is a completed part of an Upload.
+type Part struct {
+	Number int    // The number of the part, from 1
+	ETag   string // The ETag returned by the server
+	Size   int64  // The size of the part
+}
+
+// parts returns the number of parts of the upload, an empty source being uploaded as one empty part.
+func (u *Upload) parts() int {
+	if u.Size == 0 {
+		return 1
+	}
+	return int((u.Size + u.PartSize - 1) / u.PartSize)
+}
+
+// Client uploads files to an S3 bucket. Its methods are the transfers of a FileMetadataMap,
+// they can be called concurrently.
+type Client struct {
+	http     *http.Client           // Sends the requests
+	base     *url.URL               // The URL of the bucket
+	prefix   string                 // The prefix of the keys of the relative target paths
+	files    reflux.FileMetadataMap // The files of the server, whose transfer attributes hold their uploads
+	partSize int64                  // The size of the parts of the new uploads
+	signer   *signer                // Signs the requests, nil if the server needs no authentication
+}
+
+// FromManager returns a Client for the server info of the TransferManager, or for the profile set with WithServer.
+func FromManager(tm *reflux.TransferManager, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	info, err := tm.GetServerInfo()
+	if o.server != reflux.DefaultServer {
+		info, err = tm.Server(o.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(tm, info, opts...)
+}
+
+// New returns a Client for the given server, storing the uploads in the transfer attributes of the files of the
+// server profile set with WithServer. The scheme of the server must be reflux.SchemeS3 and its BaseDir must hold the bucket.
+// The User of the server is the access key ID when it uses reflux.AuthCredential.
+func New(tm *reflux.TransferManager, info *reflux.ServerInfo, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if info.Scheme != reflux.SchemeS3 {
+		return nil, errors.Wrap(ErrUnsupportedScheme, info.Scheme)
+	}
+	host, err := info.HostPort()
+	if err != nil {
+		return nil, err
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(info.BaseDir, "/"), "/")
+	if bucket == "" {
+		return nil, ErrNoBucket
+	}
+
+	scheme := reflux.SchemeHTTPS
+	if info.Options.Get(TLSOption) == "false" {
+		scheme = reflux.SchemeHTTP
+	}
+	c := &Client{
+		http:     o.client,
+		base:     &url.URL{Scheme: scheme, Host: host, Path: "/" + bucket},
+		prefix:   prefix,
+		files:    tm.Files.Server(o.server),
+		partSize: o.partSize,
+	}
+
+	switch auth := info.Auth; auth.Method {
+	case reflux.AuthNone:
+	case reflux.AuthCredential:
+		if o.credentials == nil {
+			return nil, errors.Wrapf(ErrNoCredentials, "credential '%s'", auth.CredentialID)
+		}
+		secret, err := o.credentials(auth.CredentialID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve credential '%s'", auth.CredentialID)
+		}
+		c.signer = &signer{accessKey: info.User, secretKey: secret, region: info.Options.Get(RegionOption)}
+		if c.signer.region == "" {
+			c.signer.region = DefaultRegion
+		}
+	default:
+		return nil, errors.Wrap(ErrUnsupportedAuth, string(auth.Method))
+	}
+
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: info.ConnectTimeout}).DialContext
+		transport.ResponseHeaderTimeout = info.IOTimeout
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// Upload is a reflux.Transfer uploading sourcePath to the object of targetPath. An upload started by a previous
+// attempt is resumed from its missing parts. It returns the bytes held by the completed parts,
+// the size of the source once the upload is complete.
+func (c *Client) Upload(sourcePath string, targetPath string) (int, error) {
+	return c.upload(context.Background(), sourcePath, targetPath, nil)
+}
+
+// UploadFrom is a reflux.ResumableTransfer uploading sourcePath like Upload. The parts to upload are the ones
+// missing from the stored Upload whatever the offset, the bytes of the completed parts past offset are returned.
+func (c *Client) UploadFrom(sourcePath string, targetPath string, offset int) (int, error) {
+	return c.UploadFromContext(context.Background(), sourcePath, targetPath, offset)
+}
+
+// UploadFromContext is a reflux.ResumableContextTransfer uploading sourcePath like UploadFrom,
+// the requests being cancelled with ctx.
+func (c *Client) UploadFromContext(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+	done, err := c.upload(ctx, sourcePath, targetPath, nil)
+	if done < offset {
+		return 0, err
+	}
+	return done - offset, err
+}
+
+// UploadProgress is a reflux.ProgressTransfer uploading sourcePath like Upload.
+// The bytes of the parts completed by a previous attempt are reported to progress first.
+func (c *Client) UploadProgress(ctx context.Context, sourcePath string, targetPath string, progress *reflux.Progress) (int, error) {
+	return c.upload(ctx, sourcePath, targetPath, progress)
+}
+
+// Reset aborts the upload stored for sourcePath and resets its file metadata, so it is uploaded from the start.
+// FileMetadataMap.Reset keeps the stored upload, which is resumed if the source did not change.
+func (c *Client) Reset(ctx context.Context, sourcePath string) error {
+	attrs := c.files.Attributes(sourcePath)
+	upload, ok, err := reflux.GetAttrIn[Upload](attrs, UploadAttr)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := c.abort(ctx, upload.Key, upload.ID); err != nil && !errors.Is(err, ErrNoSuchUpload) {
+			return err
+		}
+		if err := attrs.Delete(UploadAttr); err != nil {
+			return err
+		}
+	}
+	return c.files.Reset(sourcePath)
+}
+
+// AbortOrphans aborts the multipart uploads below the prefix of the client that are not stored for any file of
+// any server, such as the uploads of the files deleted with FileMetadataMap.Delete.
+// The prefix must not be shared with other jobs and no upload may be running. It returns the keys aborted.
+func (c *Client) AbortOrphans(ctx context.Context) ([]string, error) {
+	files := c.files.All()
+	known := make(map[string]bool, len(files))
+	for _, meta := range files {
+		upload, ok, err := reflux.GetAttrIn[Upload](c.files.Server(meta.Server).Attributes(meta.SourcePath), UploadAttr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			known[upload.ID] = true
+		}
+	}
+
+	var aborted []string
+	query := url.Values{"uploads": {""}}
+	if c.prefix != "" {
+		query.Set("prefix", c.prefix+"/")
+	}
+	for {
+		var result struct {
+			IsTruncated        bool
+			NextKeyMarker      string
+			NextUploadIdMarker string
+			Uploads            []struct {
+				Key      string
+				UploadId string
+			} `xml:"Upload"`
+		}
+		if err := c.do(ctx, http.MethodGet, "", query, nil, &result); err != nil {
+			return aborted, err
+		}
+
+		for _, upload := range result.Uploads {
+			if known[upload.UploadId] {
+				continue
+			}
+			if err := c.abort(ctx, upload.Key, upload.UploadId); err != nil && !errors.Is(err, ErrNoSuchUpload) {
+				return aborted, err
+			}
+			aborted = append(aborted, upload.Key)
+		}
+
+		if !result.IsTruncated {
+			return aborted, nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("upload-id-marker", result.NextUploadIdMarker)
+	}
+}
+
+// key returns the key of the object of a target path. The paths that are not absolute are below the prefix.
+func (c *Client) key(targetPath string) string {
+	targetPath = filepath.ToSlash(targetPath)
+	if path.IsAbs(targetPath) || c.prefix == "" {
+		return strings.TrimPrefix(path.Clean(targetPath), "/")
+	}
+	return path.Join(c.prefix, targetPath)
+}
+
+// upload uploads the missing parts of sourcePath and completes the upload.
+// It returns the bytes held by the completed parts. The progress is optional.
+func (c *Client) upload(ctx context.Context, sourcePath string, targetPath string, progress *reflux.Progress) (int, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	attrs := c.files.Attributes(sourcePath)
+	upload, err := c.start(ctx, attrs, c.key(targetPath), info)
+	if err != nil {
+		return 0, err
+	}
+
+	completed := make(map[int]bool, len(upload.Parts))
+	done := 0
+	for _, part := range upload.Parts {
+		completed[part.Number] = true
+		done += int(part.Size)
+	}
+	if progress != nil && done > 0 {
+		if err := progress.Add(done); err != nil {
+			return done, err
+		}
+	}
+
+	bufSize := upload.PartSize
+	if upload.Size < bufSize {
+		bufSize = upload.Size
+	}
+	buf := make([]byte, bufSize)
+	for number := 1; number <= upload.parts(); number++ {
+		if completed[number] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+
+		offset := int64(number-1) * upload.PartSize
+		data := buf
+		if rest := upload.Size - offset; rest < int64(len(buf)) {
+			data = buf[:rest]
+		}
+		if _, err := source.ReadAt(data, offset); err != nil {
+			return done, errors.Wrapf(err, "failed to read part %d of '%s'", number, sourcePath)
+		}
+
+		etag, err := c.uploadPart(ctx, upload, number, data, progress)
+		if errors.Is(err, ErrNoSuchUpload) {
+			// The upload expired or was aborted, the next attempt starts a new one
+			_ = attrs.Delete(UploadAttr)
+		}
+		if err != nil {
+			return done, err
+		}
+
+		upload.Parts = append(upload.Parts, Part{Number: number, ETag: etag, Size: int64(len(data))})
+		if err := reflux.SetAttrIn(attrs, UploadAttr, *upload); err != nil {
+			return done, errors.Wrapf(err, "failed to record part %d of '%s'", number, sourcePath)
+		}
+		done += len(data)
+	}
+
+	if err := c.complete(ctx, upload); err != nil {
+		return done, err
+	}
+	return done, attrs.Delete(UploadAttr)
+}
+
+// start returns the upload stored for the source, or starts a new one if there is none. A stored upload of another
+// key or of a source that changed since is aborted.
+func (c *Client) start(ctx context.Context, attrs reflux.AttributesMap, key string, info os.FileInfo) (*Upload, error) {
+	upload, ok, err := reflux.GetAttrIn[Upload](attrs, UploadAttr)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if upload.Key == key && upload.Size == info.Size() && upload.ModTime.Equal(info.ModTime()) {
+			return &upload, nil
+		}
+		if err := c.abort(ctx, upload.Key, upload.ID); err != nil && !errors.Is(err, ErrNoSuchUpload) {
+			return nil, err
+		}
+	}
+
+	upload = Upload{Key: key, Size: info.Size(), ModTime: info.ModTime(), PartSize: c.partSize}
+	if minSize := (upload.Size + maxParts - 1) / maxParts; upload.PartSize < minSize {
+		upload.PartSize = minSize
+	}
+
+	var result struct {
+		UploadId string
+	}
+	if err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return nil, err
+	}
+	if result.UploadId == "" {
+		return nil, errors.Wrapf(ErrUnexpectedStatus, "no upload ID for '%s'", key)
+	}
+	upload.ID = result.UploadId
+
+	if err := reflux.SetAttrIn(attrs, UploadAttr, upload); err != nil {
+		return nil, errors.Wrapf(err, "failed to record upload of '%s'", key)
+	}
+	return &upload, nil
+}
+
+// uploadPart uploads a part and returns its ETag.
+func (c *Client) uploadPart(ctx context.Context, upload *Upload, number int, data []byte, progress *reflux.Progress) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.ID}}
+	req, err := c.request(ctx, http.MethodPut, upload.Key, query, data)
+	if err != nil {
+		return "", err
+	}
+	if progress != nil {
+		req.Body = io.NopCloser(io.TeeReader(bytes.NewReader(data), progress))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.Wrapf(ErrUnexpectedStatus, "no ETag for part %d of '%s'", number, upload.Key)
+	}
+	return etag, nil
+}
+
+// complete completes the upload from its parts. An upload completed by a previous attempt that was interrupted
+// before it was recorded is accepted if the object has the size of the source.
+func (c *Client) complete(ctx context.Context, upload *Upload) error {
+	var body struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	parts := append([]Part{}, upload.Parts...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	for _, part := range parts {
+		body.Parts = append(body.Parts, struct {
+			PartNumber int
+			ETag       string
+		}{part.Number, part.ETag})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(ctx, http.MethodPost, upload.Key, url.Values{"uploadId": {upload.ID}}, data, nil)
+	if !errors.Is(err, ErrNoSuchUpload) {
+		return err
+	}
+
+	req, errHead := c.request(ctx, http.MethodHead, upload.Key, nil, nil)
+	if errHead != nil {
+		return errHead
+	}
+	resp, errHead := c.http.Do(req)
+	if errHead != nil {
+		return errHead
+	}
+	closeBody(resp)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != upload.Size {
+		return err
+	}
+	return nil
+}
+
+// abort aborts the upload of the given ID.
+func (c *Client) abort(ctx context.Context, key string, id string) error {
+	return c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {id}}, nil, nil)
+}
+
+// do sends a request on the object of the given key, or on the bucket if it is empty, and decodes the XML
+// response into result if it is not nil.
+func (c *Client) do(ctx context.Context, method string, key string, query url.Values, body []byte, result any) error {
+	req, err := c.request(ctx, method, key, query, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+
+	// The completion of an upload may fail after the status was sent, the error is then in the body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := xmlError(resp, data); err != nil {
+		return err
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return errors.Wrapf(ErrUnexpectedStatus, "%s %s: %s", method, req.URL, err)
+	}
+	return nil
+}
+
+// request returns a signed request on the object of the given key, or on the bucket if it is empty.
+func (c *Client) request(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *c.base
+	if key != "" {
+		u.Path = c.base.Path + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	if c.signer != nil {
+		c.signer.sign(req, hashHex(body), time.Now())
+	}
+	return req, nil
+}
+
+// responseError returns the error of an unexpected response, matching ErrNoSuchUpload if the upload is unknown.
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err := xmlError(resp, data); err != nil {
+		return err
+	}
+	return errors.Wrapf(ErrUnexpectedStatus, "%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+}
+
+// xmlError returns the error described by an XML error document, nil if data is not one.
+func xmlError(resp *http.Response, data []byte) error {
+	var doc struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &doc) != nil || doc.XMLName.Local != "Error" {
+		return nil
+	}
+
+	err := ErrUnexpectedStatus
+	if doc.Code == "NoSuchUpload" {
+		err = ErrNoSuchUpload
+	}
+	return errors.Wrapf(err, "%s %s: %s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, doc.Code, doc.Message)
+}
+
+// closeBody drains and closes the body of a response, so its connection is reused.
+func closeBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,481 @@
+package s3transfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gopkg.in/ro-ag/reflux.v0"
+	"gopkg.in/ro-ag/reflux.v0/s3transfer"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	lockFile := filepath.Join(dir, "s3.lock")
+	server := newServer(t, "AKIDEXAMPLE", "eu-west-3")
+
+	open := func() (*reflux.TransferManager, *s3transfer.Client) {
+		tm, err := reflux.NewTransferManager(reflux.WithLockFile(lockFile), reflux.WithSignalHandling(false))
+		if err != nil {
+			t.Fatalf("Failed to create TransferManager: %v", err)
+		}
+		client, err := s3transfer.FromManager(tm, s3transfer.WithPartSize(64<<10), s3transfer.WithCredentials(func(id string) (string, error) {
+			return "secret-" + id, nil
+		}))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		return tm, client
+	}
+
+	tm, err := reflux.NewTransferManager(reflux.WithLockFile(lockFile), reflux.WithSignalHandling(false))
+	if err != nil {
+		t.Fatalf("Failed to create TransferManager: %v", err)
+	}
+	err = tm.StoreOrUpdateServerInfo(&reflux.ServerInfo{
+		Address: "127.0.0.1",
+		Port:    server.port,
+		User:    "AKIDEXAMPLE",
+		Scheme:  reflux.SchemeS3,
+		BaseDir: "bucket/backups",
+		Auth:    reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "s3"},
+		Options: reflux.NewServerOptions(map[string]string{s3transfer.RegionOption: "eu-west-3", s3transfer.TLSOption: "false"}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to store server info: %v", err)
+	}
+	if err := tm.Close(); err != nil {
+		t.Fatalf("Failed to close TransferManager: %v", err)
+	}
+
+	data := make([]byte, 300<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	write := func(name string, content []byte) string {
+		sourcePath := filepath.Join(dir, name)
+		if err := os.WriteFile(sourcePath, content, 0600); err != nil {
+			t.Fatalf("Failed to write source: %v", err)
+		}
+		return sourcePath
+	}
+	sourcePath := write("a.bin", data)
+
+	// The upload fails on its third part, the upload ID and the first two parts are stored
+	tm, client := open()
+	if err := tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: "a.bin"}); err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	server.failPart(3)
+	if _, err := tm.Files.Operate(client.Upload); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	if meta, _ := tm.Files.Load(sourcePath); meta.Status != reflux.StatusFailed || meta.BytesTransferred != 128<<10 {
+		t.Errorf("Unexpected file metadata after failed upload: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	upload, ok, err := reflux.GetAttrIn[s3transfer.Upload](tm.Files.Attributes(sourcePath), s3transfer.UploadAttr)
+	if err != nil || !ok || upload.Key != "backups/a.bin" || len(upload.Parts) != 2 {
+		t.Fatalf("Unexpected stored upload: %+v, %t, %v", upload, ok, err)
+	}
+	if err := tm.Close(); err != nil {
+		t.Fatalf("Failed to close TransferManager: %v", err)
+	}
+
+	// After a restart only the missing parts are uploaded
+	tm, client = open()
+	if _, err := tm.Files.Resume(client.UploadFrom); err != nil {
+		t.Fatalf("Failed to resume upload: %v", err)
+	}
+	if meta, _ := tm.Files.Load(sourcePath); meta.Status != reflux.StatusCompleted || meta.BytesTransferred != len(data) {
+		t.Errorf("Unexpected file metadata after resumed upload: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	server.check(t, "/bucket/backups/a.bin", data)
+	if parts := server.partsUploaded(upload.ID); !reflect.DeepEqual(parts, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected parts uploaded: %v", parts)
+	}
+	if tm.Files.Attributes(sourcePath).Exists(s3transfer.UploadAttr) {
+		t.Error("Upload still stored once complete")
+	}
+
+	// The upload of a source changed since the failure is restarted
+	changedPath := write("b.bin", data[:200<<10])
+	server.failPart(2)
+	if _, err := client.Upload(changedPath, "b.bin"); err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	changed := append([]byte("changed "), data[:100<<10]...)
+	write("b.bin", changed)
+	if n, err := client.Upload(changedPath, "b.bin"); err != nil || n != len(changed) {
+		t.Fatalf("Unexpected upload of changed source: %d, %v", n, err)
+	}
+	server.check(t, "/bucket/backups/b.bin", changed)
+
+	// Reset aborts the stored upload
+	resetPath := write("c.bin", data)
+	if err := tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: resetPath, TargetPath: "c.bin"}); err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	server.failPart(2)
+	if _, err := client.Upload(resetPath, "c.bin"); err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if err := client.Reset(context.Background(), resetPath); err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+	if meta, _ := tm.Files.Load(resetPath); meta.Status != reflux.StatusNotStarted {
+		t.Errorf("Unexpected status after reset: %s", meta.Status)
+	}
+	if tm.Files.Attributes(resetPath).Exists(s3transfer.UploadAttr) {
+		t.Error("Upload still stored after reset")
+	}
+	if uploads := server.uploads(); len(uploads) != 0 {
+		t.Errorf("Unexpected uploads after reset: %v", uploads)
+	}
+
+	// The upload of a deleted file is aborted as an orphan, the uploads outside the prefix are kept
+	server.failPart(2)
+	if _, err := client.Upload(resetPath, "c.bin"); err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if err := tm.Files.Delete(resetPath); err != nil {
+		t.Fatalf("Failed to delete file metadata: %v", err)
+	}
+	server.start("other/d.bin")
+	aborted, err := client.AbortOrphans(context.Background())
+	if err != nil || !reflect.DeepEqual(aborted, []string{"backups/c.bin"}) {
+		t.Errorf("Unexpected orphans aborted: %v, %v", aborted, err)
+	}
+	if uploads := server.uploads(); !reflect.DeepEqual(uploads, []string{"other/d.bin"}) {
+		t.Errorf("Unexpected uploads after abort: %v", uploads)
+	}
+
+	// FileMetadataMap.Reset keeps the stored upload, which is resumed
+	if err := tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: resetPath, TargetPath: "c.bin"}); err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	server.failPart(2)
+	if _, err := client.Upload(resetPath, "c.bin"); err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+	if err := tm.Files.Reset(resetPath); err != nil {
+		t.Fatalf("Failed to reset file metadata: %v", err)
+	}
+	if !tm.Files.Attributes(resetPath).Exists(s3transfer.UploadAttr) {
+		t.Error("Upload not kept by FileMetadataMap.Reset")
+	}
+	if n, err := client.Upload(resetPath, "c.bin"); err != nil || n != len(data) {
+		t.Fatalf("Unexpected upload after reset: %d, %v", n, err)
+	}
+	server.check(t, "/bucket/backups/c.bin", data)
+
+	// A stored upload unknown to the server is dropped by Reset
+	if err := reflux.SetAttrIn(tm.Files.Attributes(sourcePath), s3transfer.UploadAttr, upload); err != nil {
+		t.Fatalf("Failed to set upload: %v", err)
+	}
+	if err := client.Reset(context.Background(), sourcePath); err != nil {
+		t.Errorf("Failed to reset with an unknown upload: %v", err)
+	}
+
+	// Each server keeps its own upload of the same file, the uploads of every server are not orphans
+	err = tm.StoreServer("dr", &reflux.ServerInfo{
+		Address: "127.0.0.1",
+		Port:    server.port,
+		User:    "AKIDEXAMPLE",
+		Scheme:  reflux.SchemeS3,
+		BaseDir: "bucket/backups",
+		Auth:    reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "s3"},
+		Options: reflux.NewServerOptions(map[string]string{s3transfer.RegionOption: "eu-west-3", s3transfer.TLSOption: "false"}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to store server: %v", err)
+	}
+	dr, err := s3transfer.FromManager(tm, s3transfer.WithServer("dr"), s3transfer.WithPartSize(64<<10),
+		s3transfer.WithCredentials(func(id string) (string, error) {
+			return "secret-" + id, nil
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	drFiles := tm.Files.Server("dr")
+	for files, target := range map[reflux.FileMetadataMap]string{tm.Files: "c.bin", drFiles: "dr/c.bin"} {
+		if err := files.StoreOrUpdate(reflux.FileMetadata{SourcePath: resetPath, TargetPath: target}); err != nil {
+			t.Fatalf("Failed to store file metadata: %v", err)
+		}
+	}
+	for c, target := range map[*s3transfer.Client]string{client: "c.bin", dr: "dr/c.bin"} {
+		server.failPart(2)
+		if _, err := c.Upload(resetPath, target); err == nil {
+			t.Fatal("Expected the upload to fail")
+		}
+	}
+	for files, key := range map[reflux.FileMetadataMap]string{tm.Files: "backups/c.bin", drFiles: "backups/dr/c.bin"} {
+		if upload, ok, err := reflux.GetAttrIn[s3transfer.Upload](files.Attributes(resetPath), s3transfer.UploadAttr); err != nil || !ok || upload.Key != key {
+			t.Errorf("Unexpected stored upload: %+v, %t, %v, expected %s", upload, ok, err, key)
+		}
+	}
+	if aborted, err := client.AbortOrphans(context.Background()); err != nil || len(aborted) != 0 {
+		t.Errorf("Unexpected orphans aborted: %v, %v", aborted, err)
+	}
+
+	// Once every file is deleted, their uploads are orphans
+	for _, meta := range tm.Files.All() {
+		if err := tm.Files.Server(meta.Server).Delete(meta.SourcePath); err != nil {
+			t.Fatalf("Failed to delete file metadata: %v", err)
+		}
+	}
+	aborted, err = client.AbortOrphans(context.Background())
+	sort.Strings(aborted)
+	if err != nil || !reflect.DeepEqual(aborted, []string{"backups/c.bin", "backups/dr/c.bin"}) {
+		t.Errorf("Unexpected orphans aborted: %v, %v", aborted, err)
+	}
+	if uploads := server.uploads(); !reflect.DeepEqual(uploads, []string{"other/d.bin"}) {
+		t.Errorf("Unexpected uploads after abort: %v", uploads)
+	}
+
+	// The requests without the credential are rejected
+	anonymous, err := s3transfer.New(tm, &reflux.ServerInfo{Address: "127.0.0.1", Port: server.port, User: "user",
+		Scheme: reflux.SchemeS3, BaseDir: "bucket", Options: reflux.NewServerOptions(map[string]string{s3transfer.TLSOption: "false"})})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if _, err := anonymous.Upload(sourcePath, "a.bin"); !errors.Is(err, s3transfer.ErrUnexpectedStatus) {
+		t.Errorf("Expected ErrUnexpectedStatus, got %v", err)
+	}
+
+	// Only the s3 servers with a bucket are supported
+	if _, err := s3transfer.New(tm, &reflux.ServerInfo{Address: "localhost", Port: 443, User: "user", Scheme: reflux.SchemeHTTPS, BaseDir: "bucket"}); !errors.Is(err, s3transfer.ErrUnsupportedScheme) {
+		t.Errorf("Expected ErrUnsupportedScheme, got %v", err)
+	}
+	if _, err := s3transfer.New(tm, &reflux.ServerInfo{Address: "localhost", Port: 443, User: "user", Scheme: reflux.SchemeS3}); !errors.Is(err, s3transfer.ErrNoBucket) {
+		t.Errorf("Expected ErrNoBucket, got %v", err)
+	}
+
+	if err := tm.Finish(); err != nil {
+		t.Errorf("Failed to finish TransferManager: %v", err)
+	}
+}
+
+// testServer is an S3 server holding the objects and the multipart uploads of a bucket in memory.
+type testServer struct {
+	port      int
+	accessKey string
+	region    string
+	mu        sync.Mutex
+	objects   map[string][]byte      // The content of the objects, by path
+	pending   map[string]*testUpload // The multipart uploads in progress, by ID
+	received  map[string][]int       // The numbers of the parts received, by upload ID
+	fail      int                    // The number of the next part to reject, 0 for none
+	next      int                    // The number of the next upload ID
+}
+
+// testUpload is a multipart upload in progress.
+type testUpload struct {
+	path  string
+	parts map[int][]byte
+}
+
+// newServer starts an S3 server requiring the requests to be signed with the given access key in region.
+func newServer(t *testing.T, accessKey string, region string) *testServer {
+	s := &testServer{
+		accessKey: accessKey,
+		region:    region,
+		objects:   make(map[string][]byte),
+		pending:   make(map[string]*testUpload),
+		received:  make(map[string][]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(server.Close)
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	s.port, _ = strconv.Atoi(port)
+	return s
+}
+
+// failPart makes the server reject the next upload of the part of the given number.
+func (s *testServer) failPart(number int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = number
+}
+
+// start starts a multipart upload of the key of the bucket.
+func (s *testServer) start(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startLocked("/bucket/" + key)
+}
+
+func (s *testServer) startLocked(path string) string {
+	s.next++
+	id := fmt.Sprintf("upload-%d", s.next)
+	s.pending[id] = &testUpload{path: path, parts: make(map[int][]byte)}
+	return id
+}
+
+// uploads returns the keys of the uploads in progress.
+func (s *testServer) uploads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0)
+	for _, upload := range s.pending {
+		keys = append(keys, strings.TrimPrefix(upload.path, "/bucket/"))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// partsUploaded returns the numbers of the parts received for the upload, in order.
+func (s *testServer) partsUploaded(id string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int{}, s.received[id]...)
+}
+
+func (s *testServer) check(t *testing.T, path string, data []byte) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.objects[path], data) {
+		t.Errorf("Unexpected content of '%s': %d bytes, expected %d", path, len(s.objects[path]), len(data))
+	}
+}
+
+// serveHTTP serves the multipart upload requests of S3.
+func (s *testServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	credential := "Credential=" + s.accessKey + "/"
+	scope := "/" + s.region + "/s3/aws4_request"
+	if auth := r.Header.Get("Authorization"); !strings.Contains(auth, credential) || !strings.Contains(auth, scope) ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := r.URL.Query()
+	upload := s.pending[query.Get("uploadId")]
+	if query.Has("uploadId") && upload == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadId string
+		}{UploadId: s.startLocked(r.URL.Path)})
+
+	case r.Method == http.MethodPut && upload != nil:
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == s.fail {
+			s.fail = 0
+			writeError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		upload.parts[number] = body
+		s.received[query.Get("uploadId")] = append(s.received[query.Get("uploadId")], number)
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == http.MethodPost && upload != nil:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || part.ETag != etag(data) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+		}
+		s.objects[upload.path] = object
+		delete(s.pending, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			ETag    string
+		}{ETag: etag(object)})
+
+	case r.Method == http.MethodDelete && upload != nil:
+		delete(s.pending, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		type listed struct {
+			Key      string
+			UploadId string
+		}
+		var result struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			IsTruncated bool
+			Uploads     []listed `xml:"Upload"`
+		}
+		prefix := r.URL.Path + "/" + query.Get("prefix")
+		for id, upload := range s.pending {
+			if strings.HasPrefix(upload.path, prefix) {
+				result.Uploads = append(result.Uploads, listed{strings.TrimPrefix(upload.path, r.URL.Path+"/"), id})
+			}
+		}
+		writeXML(w, result)
+
+	case r.Method == http.MethodHead:
+		object, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// etag returns the ETag of a part or an object.
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	data, _ := xml.Marshal(v)
+	_, _ = w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(status)})
+}
@@ -1,90 +1,421 @@
 package reflux
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
-	bolt "go.etcd.io/bbolt"
 	"net"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DefaultServer is the name of the server profile of StoreOrUpdateServerInfo and GetServerInfo.
+// It is the key the server info was stored under before the profiles were introduced.
+const DefaultServer = "Info"
+
 var (
 	ErrServerInfoNotSet     = errors.New("server info not set")
+	ErrServerNotFound       = errors.New("server profile not found")
 	ErrInvalidAddressFormat = errors.New("invalid address format")
+	ErrEmptyAddress         = errors.New("empty address")
+	ErrInvalidHostname      = errors.New("invalid hostname")
+	ErrInvalidPort          = errors.New("invalid port")
+	ErrEmptyUser            = errors.New("empty user")
+	ErrUnresolvableAddress  = errors.New("address cannot be resolved")
+	ErrInvalidScheme        = errors.New("invalid scheme")
+	ErrInvalidAuth          = errors.New("invalid auth method reference")
+	ErrInvalidTimeout       = errors.New("invalid timeout")
+	ErrInvalidOption        = errors.New("invalid option")
+)
+
+const (
+	SchemeSFTP  = "sftp"
+	SchemeFTP   = "ftp"
+	SchemeS3    = "s3"
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+// AuthMethod is the way to authenticate to a server.
+type AuthMethod string
+
+const (
+	AuthNone       AuthMethod = ""           // No authentication, or handled by the transfer
+	AuthKey        AuthMethod = "key"        // A private key read from AuthRef.KeyPath
+	AuthAgent      AuthMethod = "agent"      // The keys of the SSH agent
+	AuthCredential AuthMethod = "credential" // A secret kept in a credential store under AuthRef.CredentialID
+)
+
+// AuthRef references how to authenticate to a server. It never holds the secret itself.
+type AuthRef struct {
+	Method       AuthMethod // The authentication method
+	KeyPath      string     // The path of the private key, for AuthKey
+	CredentialID string     // The ID of the secret in the credential store, for AuthCredential
+}
+
+const (
+	maxHostnameLength = 253 // The maximum length of a hostname, without the trailing dot
+	maxLabelLength    = 63  // The maximum length of a label of a hostname
+	minPort           = 1
+	maxPort           = 65535
 )
 
 // ServerInfo represents information about the server.
 type ServerInfo struct {
-	Address string // The address of the server
+	Address string // The address of the server: a hostname, an IP address, a bracketed IPv6 literal or a URL, stored as its host
 	Port    int    // The port of the server
 	User    string // The user of the server
+
+	Scheme         string        // The protocol used to reach the server, such as SchemeSFTP, empty if unknown
+	BaseDir        string        // The remote directory the target paths are relative to, relative to the login directory if not absolute
+	Auth           AuthRef       // How to authenticate to the server
+	ConnectTimeout time.Duration // The maximum time to establish a connection, 0 for the default of the transfer
+	IOTimeout      time.Duration // The maximum time a read or write may block, 0 for the default of the transfer
+	Options        ServerOptions // The protocol specific options, such as the region of an S3 bucket
 }
 
-// validateAddress checks if the address is a valid URL, DNS name, or IP address.
-func (si *ServerInfo) validate() error {
-	if _, err := url.Parse(si.Address); err != nil {
-		return fmt.Errorf("%w: %s", ErrInvalidAddressFormat, err)
+// ServerOptions are the protocol specific options of a server, encoded as a URL query sorted by name,
+// such as "region=eu-west-1&tls=false". It is a string so that ServerInfo stays comparable with ==.
+type ServerOptions string
+
+// NewServerOptions returns the options of the given names and values.
+func NewServerOptions(options map[string]string) ServerOptions {
+	values := url.Values{}
+	for name, value := range options {
+		values.Set(name, value)
 	}
+	return ServerOptions(values.Encode())
+}
+
+// Get returns the value of the option of the given name, empty if it is not set.
+func (o ServerOptions) Get(name string) string {
+	values, _ := url.ParseQuery(string(o))
+	return values.Get(name)
+}
 
-	if _, err := net.ResolveIPAddr("ip", si.Address); err != nil {
-		return fmt.Errorf("%w: %s", ErrInvalidAddressFormat, err)
+// Map returns the values of the options by name.
+func (o ServerOptions) Map() map[string]string {
+	values, _ := url.ParseQuery(string(o))
+	options := make(map[string]string, len(values))
+	for name := range values {
+		options[name] = values.Get(name)
 	}
+	return options
+}
+
+// ValidationError describes why a ServerInfo is invalid.
+// It matches the error of the failed check with errors.Is, such as ErrInvalidPort or ErrUnresolvableAddress.
+type ValidationError struct {
+	Field string // The invalid field of the ServerInfo
+	Value string // The invalid value
+	Err   error  // The failed check
+}
+
+// Error returns the description of the failed check.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("server %s '%s': %s", e.Field, e.Value, e.Err)
+}
+
+// Unwrap returns the error of the failed check.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
 
-	if si.Port < 0 || si.Port > 65535 {
-		return fmt.Errorf("invalid port: %d", si.Port)
+// Resolver resolves the hostnames of the servers. *net.Resolver implements it.
+type Resolver interface {
+	// LookupHost returns the addresses of the given host.
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Validate checks the server info without any network access: the address must be a hostname, an IP address,
+// a bracketed IPv6 literal or a URL with a host, the port must be between 1 and 65535 and the user must be set.
+// The scheme, the auth method reference, the timeouts and the option names are also checked.
+// It returns a *ValidationError describing the first failed check.
+func (si *ServerInfo) Validate() error {
+	if _, err := si.host(); err != nil {
+		return err
+	}
+
+	if si.Port < minPort || si.Port > maxPort {
+		return &ValidationError{Field: "port", Value: strconv.Itoa(si.Port), Err: ErrInvalidPort}
 	}
 
 	if si.User == "" {
-		return fmt.Errorf("empty user")
+		return &ValidationError{Field: "user", Err: ErrEmptyUser}
+	}
+
+	if si.Scheme != "" && !validScheme(si.Scheme) {
+		return &ValidationError{Field: "scheme", Value: si.Scheme, Err: ErrInvalidScheme}
+	}
+
+	if err := si.Auth.validate(); err != nil {
+		return &ValidationError{Field: "auth", Value: string(si.Auth.Method), Err: err}
+	}
+
+	for field, timeout := range map[string]time.Duration{"connect timeout": si.ConnectTimeout, "io timeout": si.IOTimeout} {
+		if timeout < 0 {
+			return &ValidationError{Field: field, Value: timeout.String(), Err: ErrInvalidTimeout}
+		}
+	}
+
+	options, err := url.ParseQuery(string(si.Options))
+	if err != nil {
+		return &ValidationError{Field: "options", Value: string(si.Options), Err: fmt.Errorf("%w: %s", ErrInvalidOption, err)}
+	}
+	for name, values := range options {
+		if name == "" || reservedQueryKeys[name] || len(values) > 1 {
+			return &ValidationError{Field: "option", Value: name, Err: ErrInvalidOption}
+		}
 	}
 
 	return nil
 }
 
-// GetServerInfo returns the server information.
+// normalize reduces the address of a valid server info to its host, the IPv6 literals without brackets,
+// and sorts its options, so that URL and ParseServerURL return the same server info.
+func (si *ServerInfo) normalize() {
+	si.Address, _ = si.host()
+	si.Options = NewServerOptions(si.Options.Map())
+}
+
+// HostPort validates the server info and returns its host and port joined for net.Dial.
+func (si *ServerInfo) HostPort() (string, error) {
+	if err := si.Validate(); err != nil {
+		return "", err
+	}
+
+	host, _ := si.host()
+	return net.JoinHostPort(host, strconv.Itoa(si.Port)), nil
+}
+
+// validate checks that the reference of the auth method is set.
+func (a AuthRef) validate() error {
+	switch {
+	case a.Method == AuthKey && a.KeyPath == "":
+		return fmt.Errorf("%w: key path not set", ErrInvalidAuth)
+	case a.Method == AuthCredential && a.CredentialID == "":
+		return fmt.Errorf("%w: credential ID not set", ErrInvalidAuth)
+	case a.Method != AuthNone && a.Method != AuthKey && a.Method != AuthAgent && a.Method != AuthCredential:
+		return fmt.Errorf("%w: unknown method", ErrInvalidAuth)
+	}
+	return nil
+}
+
+// validScheme returns whether s is a valid URL scheme: a letter followed by letters, digits, '+', '-' or '.'.
+func validScheme(s string) bool {
+	for i, c := range s {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Resolve validates the server info and checks that its host is resolved by resolver.
+// The IP addresses are not resolved. A failed lookup returns a *ValidationError matching ErrUnresolvableAddress.
+func (si *ServerInfo) Resolve(ctx context.Context, resolver Resolver) error {
+	if err := si.Validate(); err != nil {
+		return err
+	}
+
+	host, _ := si.host()
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if _, err := resolver.LookupHost(ctx, host); err != nil {
+		return &ValidationError{Field: "address", Value: si.Address, Err: fmt.Errorf("%w: %s", ErrUnresolvableAddress, err)}
+	}
+	return nil
+}
+
+// host returns the host of the address, the IPv6 literals without brackets.
+func (si *ServerInfo) host() (string, error) {
+	invalid := func(err error) (string, error) {
+		return "", &ValidationError{Field: "address", Value: si.Address, Err: err}
+	}
+
+	address := si.Address
+	switch {
+	case address == "":
+		return invalid(ErrEmptyAddress)
+	case strings.Contains(address, "://"):
+		u, err := url.Parse(address)
+		if err != nil {
+			return invalid(fmt.Errorf("%w: %s", ErrInvalidAddressFormat, err))
+		}
+		if u.Hostname() == "" {
+			return invalid(fmt.Errorf("%w: URL without host", ErrInvalidAddressFormat))
+		}
+		address = u.Hostname()
+		if strings.Contains(address, ":") {
+			// The brackets of an IPv6 literal are removed by Hostname.
+			address = "[" + address + "]"
+		}
+	}
+
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		ip := net.ParseIP(address[1 : len(address)-1])
+		if ip == nil || ip.To4() != nil {
+			return invalid(fmt.Errorf("%w: invalid IPv6 literal", ErrInvalidAddressFormat))
+		}
+		return ip.String(), nil
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String(), nil
+	}
+
+	if !validHostname(address) {
+		return invalid(ErrInvalidHostname)
+	}
+	return address, nil
+}
+
+// validHostname returns whether name is a valid DNS hostname: dot separated labels of letters, digits
+// and hyphens, not starting nor ending with a hyphen. A trailing dot is allowed.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxHostnameLength {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GetServerInfo returns the server information of DefaultServer.
 // If the server information is not set, it returns nil and the ErrServerInfoNotSet error.
 func (tm *TransferManager) GetServerInfo() (*ServerInfo, error) {
-	if tm.serverInfo == nil {
+	si, err := tm.Server(DefaultServer)
+	if errors.Is(err, ErrServerNotFound) {
 		return nil, ErrServerInfoNotSet
 	}
-	si := *tm.serverInfo
-	return &si, nil
+	return si, err
 }
 
-// StoreOrUpdateServerInfo stores the server information in the database.
+// StoreOrUpdateServerInfo stores the server information of DefaultServer in the database.
 // It encodes the server info and stores it in the Lock File (BoltDB database).
 func (tm *TransferManager) StoreOrUpdateServerInfo(info *ServerInfo) error {
-	if err := info.validate(); err != nil {
+	return tm.StoreServer(DefaultServer, info)
+}
+
+// StoreServer stores or updates the server profile of the given name in the database.
+// The address is stored as its host, see Address.
+func (tm *TransferManager) StoreServer(name string, info *ServerInfo) error {
+	if name == "" {
+		return errors.New("empty server name")
+	}
+	if err := tm.validateServer(info); err != nil {
 		return err
 	}
-	err := tm.db.Update(func(tx *bolt.Tx) error {
+	normalized := *info
+	normalized.normalize()
+	info = &normalized
+	err := tm.db.Update(func(tx Tx) error {
 		b, err := tx.CreateBucketIfNotExists(serverBucket.Bytes())
 		if err != nil {
 			return err
 		}
 
 		// Convert the server info to bytes.
-		buf := new(bytes.Buffer)
-		enc := gob.NewEncoder(buf)
-		if err := enc.Encode(*info); err != nil {
+		record, err := tm.serializer.encode(*info)
+		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte(serverInfoKey), buf.Bytes())
+		return b.Put([]byte(name), record)
 	})
 
 	if err != nil {
 		return err
 	}
 
-	tm.serverInfo = info
+	tm.servers.Store(name, *info)
+
+	return nil
+}
+
+// Server returns the server profile of the given name.
+// If the profile does not exist, it returns nil and an error matching ErrServerNotFound.
+func (tm *TransferManager) Server(name string) (*ServerInfo, error) {
+	si, ok := tm.servers.Load(name)
+	if !ok {
+		return nil, errors.Wrapf(ErrServerNotFound, "'%s'", name)
+	}
+	info := si.(ServerInfo)
+	return &info, nil
+}
+
+// ListServers returns the names of the server profiles, sorted.
+func (tm *TransferManager) ListServers() []string {
+	var names []string
+	tm.servers.Range(func(name, _ any) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// DeleteServer deletes the server profile of the given name.
+// The files transferred to the server are kept, see FileMetadataMap.Server.
+func (tm *TransferManager) DeleteServer(name string) error {
+	if _, ok := tm.servers.Load(name); !ok {
+		return errors.Wrapf(ErrServerNotFound, "'%s'", name)
+	}
+
+	err := tm.db.Update(func(tx Tx) error {
+		b := tx.Bucket(serverBucket.Bytes())
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
 
+	tm.servers.Delete(name)
 	return nil
 }
 
+// loadServers loads the server profiles from the database into the TransferManager's servers map.
+func (tm *TransferManager) loadServers(tx Tx) error {
+	b := tx.Bucket(serverBucket.Bytes())
+	if b == nil {
+		return nil
+	}
+
+	return loadRecords(tm.serializer, b, serverBucket, func(k []byte, info ServerInfo) error {
+		tm.servers.Store(string(k), info)
+		return nil
+	})
+}
+
+// validateServer validates the server info, resolving its host if a resolver was set with WithResolver.
+func (tm *TransferManager) validateServer(info *ServerInfo) error {
+	if tm.resolver == nil {
+		return info.Validate()
+	}
+	return info.Resolve(tm.ctx, tm.resolver)
+}
+
 // CreateServerInfo creates a new instance of the ServerInfo interface.
+// The server info is validated without any network access, see Validate.
 func CreateServerInfo(address string, port int, user string) (*ServerInfo, error) {
 	si := ServerInfo{
 		Address: address,
@@ -92,7 +423,7 @@ func CreateServerInfo(address string, port int, user string) (*ServerInfo, error
 		User:    user,
 	}
 
-	if err := si.validate(); err != nil {
+	if err := si.Validate(); err != nil {
 		return nil, err
 	}
 
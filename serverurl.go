@@ -0,0 +1,151 @@
+package reflux
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	queryAuth           = "auth"            // The query parameter of the auth method
+	queryAuthKey        = "auth-key"        // The query parameter of the path of the private key
+	queryAuthCredential = "auth-credential" // The query parameter of the credential ID
+	queryConnectTimeout = "connect-timeout" // The query parameter of the connect timeout
+	queryIOTimeout      = "io-timeout"      // The query parameter of the I/O timeout
+
+	relativeDirPrefix = "/~/" // The path prefix of a base directory relative to the login directory
+	tildeDirPrefix    = "/~"  // The path prefix of an absolute base directory starting with a tilde, written doubled
+)
+
+// reservedQueryKeys are the query parameters of the URL that cannot be used as option names.
+var reservedQueryKeys = map[string]bool{
+	queryAuth:           true,
+	queryAuthKey:        true,
+	queryAuthCredential: true,
+	queryConnectTimeout: true,
+	queryIOTimeout:      true,
+}
+
+// defaultPorts are the ports used by ParseServerURL when the URL has none.
+var defaultPorts = map[string]int{
+	SchemeSFTP:  22,
+	SchemeFTP:   21,
+	SchemeS3:    443,
+	SchemeHTTP:  80,
+	SchemeHTTPS: 443,
+}
+
+// URL returns the server info as a URL, such as sftp://user@example.com:22/data?auth=agent.
+// A relative BaseDir is written below "/~/" and the tilde starting an absolute BaseDir is doubled, so "/~/data"
+// is written "/~~/data". The auth method reference, the timeouts and the options are written as query parameters. ParseServerURL returns the same server info, its address reduced to its host
+// and its options sorted like StoreServer does.
+func (si *ServerInfo) URL() string {
+	host, err := si.host()
+	if err != nil {
+		host = si.Address
+	}
+
+	u := url.URL{
+		Scheme: si.Scheme,
+		User:   url.User(si.User),
+		Host:   net.JoinHostPort(host, strconv.Itoa(si.Port)),
+		Path:   si.BaseDir,
+	}
+	switch {
+	case si.BaseDir != "" && !strings.HasPrefix(si.BaseDir, "/"):
+		u.Path = relativeDirPrefix + si.BaseDir
+	case strings.HasPrefix(si.BaseDir, tildeDirPrefix):
+		u.Path = tildeDirPrefix + si.BaseDir[1:]
+	}
+
+	query := url.Values{}
+	for name, value := range si.Options.Map() {
+		query.Set(name, value)
+	}
+	if si.Auth.Method != AuthNone {
+		query.Set(queryAuth, string(si.Auth.Method))
+	}
+	if si.Auth.KeyPath != "" {
+		query.Set(queryAuthKey, si.Auth.KeyPath)
+	}
+	if si.Auth.CredentialID != "" {
+		query.Set(queryAuthCredential, si.Auth.CredentialID)
+	}
+	if si.ConnectTimeout != 0 {
+		query.Set(queryConnectTimeout, si.ConnectTimeout.String())
+	}
+	if si.IOTimeout != 0 {
+		query.Set(queryIOTimeout, si.IOTimeout.String())
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// ParseServerURL returns the server info of a URL written by ServerInfo.URL.
+// The default port of the scheme is used when the URL has none. A URL holding a password is refused,
+// the secrets are referenced by the auth method, see AuthRef. The server info is validated, see Validate.
+func ParseServerURL(rawURL string) (*ServerInfo, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &ValidationError{Field: "url", Value: rawURL, Err: fmt.Errorf("%w: %s", ErrInvalidAddressFormat, err)}
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, &ValidationError{Field: "url", Value: u.Redacted(), Err: fmt.Errorf("%w: password in URL", ErrInvalidAuth)}
+	}
+
+	si := &ServerInfo{
+		Address: u.Hostname(),
+		User:    u.User.Username(),
+		Scheme:  u.Scheme,
+		BaseDir: u.Path,
+	}
+	switch {
+	case strings.HasPrefix(u.Path, relativeDirPrefix):
+		si.BaseDir = strings.TrimPrefix(u.Path, relativeDirPrefix)
+	case strings.HasPrefix(u.Path, tildeDirPrefix+"~"):
+		si.BaseDir = "/" + strings.TrimPrefix(u.Path, tildeDirPrefix)
+	}
+
+	si.Port = defaultPorts[u.Scheme]
+	if port := u.Port(); port != "" {
+		if si.Port, err = strconv.Atoi(port); err != nil {
+			return nil, &ValidationError{Field: "port", Value: port, Err: ErrInvalidPort}
+		}
+	}
+
+	options := url.Values{}
+	for name, values := range u.Query() {
+		value := values[0]
+		switch name {
+		case queryAuth:
+			si.Auth.Method = AuthMethod(value)
+		case queryAuthKey:
+			si.Auth.KeyPath = value
+		case queryAuthCredential:
+			si.Auth.CredentialID = value
+		case queryConnectTimeout, queryIOTimeout:
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, &ValidationError{Field: name, Value: value, Err: ErrInvalidTimeout}
+			}
+			if name == queryConnectTimeout {
+				si.ConnectTimeout = timeout
+			} else {
+				si.IOTimeout = timeout
+			}
+		default:
+			options[name] = values
+		}
+	}
+	si.Options = ServerOptions(options.Encode())
+
+	if err := si.Validate(); err != nil {
+		return nil, err
+	}
+	si.normalize()
+	return si, nil
+}
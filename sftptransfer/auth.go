@@ -0,0 +1,68 @@
+package sftptransfer
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/ro-ag/reflux.v0"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// authMethods returns the auth methods of the options followed by the one referenced by the server info.
+// The connection to the SSH agent is kept by the client.
+func (c *Client) authMethods(o *options) ([]ssh.AuthMethod, error) {
+	methods := append([]ssh.AuthMethod{}, o.auth...)
+
+	switch auth := c.info.Auth; auth.Method {
+	case reflux.AuthKey:
+		key, err := os.ReadFile(auth.KeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read private key")
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse private key '%s'", auth.KeyPath)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+
+	case reflux.AuthAgent:
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errors.Wrap(ErrNoAgent, "SSH_AUTH_SOCK not set")
+		}
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, errors.Wrap(ErrNoAgent, err.Error())
+		}
+		c.agent = agentConn
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+
+	case reflux.AuthCredential:
+		if o.credentials == nil {
+			return nil, errors.Wrapf(ErrNoCredentials, "credential '%s'", auth.CredentialID)
+		}
+		method, err := o.credentials(auth.CredentialID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve credential '%s'", auth.CredentialID)
+		}
+		methods = append(methods, method)
+	}
+
+	return methods, nil
+}
+
+// knownHosts returns the check of the server keys listed in the known_hosts file of the user.
+func knownHosts() (ssh.HostKeyCallback, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read known hosts, set WithHostKeyCallback")
+	}
+	return callback, nil
+}
@@ -0,0 +1,18 @@
+module gopkg.in/ro-ag/reflux.v0/sftptransfer
+
+go 1.26.0
+
+require (
+	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.57.0
+	gopkg.in/ro-ag/reflux.v0 v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	go.etcd.io/bbolt v1.3.7 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+)
+
+replace gopkg.in/ro-ag/reflux.v0 => ../
@@ -0,0 +1,75 @@
+package sftptransfer
+
+import (
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+const (
+	defaultPoolSize       = 4                // The default maximum number of connections to the server
+	defaultConnectTimeout = 30 * time.Second // The default maximum time to establish a connection
+)
+
+// CredentialFunc returns the auth method of the secret kept under the given ID in a credential store.
+// It resolves the servers authenticated with reflux.AuthCredential.
+type CredentialFunc func(id string) (ssh.AuthMethod, error)
+
+// Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	hostKeyCallback ssh.HostKeyCallback // Checks the key of the server, nil for the known_hosts file of the user
+	auth            []ssh.AuthMethod    // The auth methods tried before the one of the server info
+	credentials     CredentialFunc      // Resolves the credential IDs, nil if no credential store is used
+	poolSize        int                 // The maximum number of connections to the server
+	connectTimeout  time.Duration       // The maximum time to establish a connection if the server info sets none
+}
+
+// defaultOptions returns the options of a Client.
+func defaultOptions() *options {
+	return &options{
+		poolSize:       defaultPoolSize,
+		connectTimeout: defaultConnectTimeout,
+	}
+}
+
+// WithHostKeyCallback sets the check of the key of the server.
+// By default the key must be listed in ~/.ssh/known_hosts.
+func WithHostKeyCallback(callback ssh.HostKeyCallback) Option {
+	return func(o *options) {
+		o.hostKeyCallback = callback
+	}
+}
+
+// WithAuth adds auth methods, tried before the auth method of the server info.
+func WithAuth(methods ...ssh.AuthMethod) Option {
+	return func(o *options) {
+		o.auth = append(o.auth, methods...)
+	}
+}
+
+// WithCredentials sets the resolver of the credential IDs of the servers authenticated with reflux.AuthCredential.
+func WithCredentials(credentials CredentialFunc) Option {
+	return func(o *options) {
+		o.credentials = credentials
+	}
+}
+
+// WithPoolSize sets the maximum number of connections to the server, 4 by default.
+// The transfers wait for a connection once the limit is reached.
+func WithPoolSize(size int) Option {
+	return func(o *options) {
+		if size < 1 {
+			size = 1
+		}
+		o.poolSize = size
+	}
+}
+
+// WithConnectTimeout sets the maximum time to establish a connection, 30 seconds by default.
+// The ConnectTimeout of the server info takes precedence.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = timeout
+	}
+}
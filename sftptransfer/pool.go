@@ -0,0 +1,142 @@
+package sftptransfer
+
+import (
+	"context"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// conn is an SFTP session over its own SSH connection.
+type conn struct {
+	net  *timeoutConn
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+// close closes the session and the connection.
+func (c *conn) close() {
+	_ = c.sftp.Close()
+	_ = c.ssh.Close()
+}
+
+// timeoutConn fails the reads and writes blocked for longer than the timeout while the connection is used
+// by a transfer. Every write pushes the deadline back, an idle connection has no deadline.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration // The maximum time a read or write may block, 0 for no limit
+	inUse   atomic.Bool   // Whether the connection is used by a transfer
+}
+
+// Write writes to the connection, pushing the deadline back if it is in use.
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.timeout > 0 && c.inUse.Load() {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// use marks the connection as used by a transfer or idle.
+func (c *timeoutConn) use(inUse bool) {
+	if c.timeout == 0 {
+		return
+	}
+	c.inUse.Store(inUse)
+	if inUse {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	} else {
+		_ = c.Conn.SetDeadline(time.Time{})
+	}
+}
+
+// pool keeps the idle connections to the server and limits the connections in use.
+type pool struct {
+	dial  func(ctx context.Context) (*conn, error)
+	idle  chan *conn    // The open connections not in use
+	slots chan struct{} // Holds a token per connection in use
+	mu    sync.Mutex
+	done  bool // Whether the pool is closed
+}
+
+// newPool returns a pool of at most size connections opened with dial.
+func newPool(size int, dial func(ctx context.Context) (*conn, error)) *pool {
+	return &pool{
+		dial:  dial,
+		idle:  make(chan *conn, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// get returns an idle connection, or a new one. It waits for a connection to be released once
+// the limit is reached.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.closed() {
+		<-p.slots
+		return nil, ErrClosed
+	}
+
+	var c *conn
+	select {
+	case c = <-p.idle:
+	default:
+		var err error
+		if c, err = p.dial(ctx); err != nil {
+			<-p.slots
+			return nil, err
+		}
+	}
+
+	c.net.use(true)
+	return c, nil
+}
+
+// put releases a connection. It is closed if the transfer failed with it or if the pool is closed.
+func (p *pool) put(c *conn, err error) {
+	defer func() { <-p.slots }()
+	c.net.use(false)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil || p.done {
+		c.close()
+		return
+	}
+
+	select {
+	case p.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+// closed returns whether the pool is closed.
+func (p *pool) closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+// close closes the idle connections, the connections in use are closed when they are released.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+		default:
+			return nil
+		}
+	}
+}
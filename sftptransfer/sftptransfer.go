@@ -0,0 +1,297 @@
+// Package sftptransfer provides the transfers of a TransferManager over SFTP.
+//
+// The Client connects to the server recorded in the lock file, so a job that crashed reconnects to the same
+// server and resumes its transfers. The data is written to the target path with reflux.PartialSuffix and renamed
+// once complete. The connections are pooled and shared by the concurrent transfers.
+//
+// Example:
+//
+//	client, err := sftptransfer.FromManager(tm)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer client.Close()
+//
+//	results, err := tm.Files.OperateConcurrent(ctx, client.Copy, 4)
+package sftptransfer
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ro-ag/reflux.v0"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	fsyncExtension       = "fsync@openssh.com"        // The extension syncing a remote file
+	posixRenameExtension = "posix-rename@openssh.com" // The extension renaming a remote file over an existing one
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("server scheme is not sftp")
+	ErrNoCredentials     = errors.New("no credential resolver set")
+	ErrNoAgent           = errors.New("SSH agent not available")
+	ErrClosed            = errors.New("client is closed")
+)
+
+// Client transfers files to an SFTP server. Its methods are the transfers of a FileMetadataMap,
+// they can be called concurrently.
+type Client struct {
+	info   *reflux.ServerInfo // The server the files are transferred to
+	pool   *pool              // The connections to the server
+	agent  io.Closer          // The connection to the SSH agent, nil if it is not used
+	config *ssh.ClientConfig  // The configuration of the SSH connections
+}
+
+// FromManager returns a Client connecting to the server info of the TransferManager.
+func FromManager(tm *reflux.TransferManager, opts ...Option) (*Client, error) {
+	info, err := tm.GetServerInfo()
+	if err != nil {
+		return nil, err
+	}
+	return New(info, opts...)
+}
+
+// New returns a Client connecting to the given server. The scheme of the server must be reflux.SchemeSFTP
+// or empty. The connections are opened when the files are transferred.
+func New(info *reflux.ServerInfo, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if info.Scheme != "" && info.Scheme != reflux.SchemeSFTP {
+		return nil, errors.Wrap(ErrUnsupportedScheme, info.Scheme)
+	}
+	addr, err := info.HostPort()
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback := o.hostKeyCallback
+	if hostKeyCallback == nil {
+		if hostKeyCallback, err = knownHosts(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{info: info}
+	auth, err := c.authMethods(o)
+	if err != nil {
+		return nil, err
+	}
+
+	c.config = &ssh.ClientConfig{
+		User:            info.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         info.ConnectTimeout,
+	}
+	if c.config.Timeout == 0 {
+		c.config.Timeout = o.connectTimeout
+	}
+
+	c.pool = newPool(o.poolSize, func(ctx context.Context) (*conn, error) {
+		return dial(ctx, addr, c.config, info.IOTimeout)
+	})
+	return c, nil
+}
+
+// Close closes the connections to the server. The transfers running are not interrupted,
+// their connection is closed once they are done.
+func (c *Client) Close() error {
+	err := c.pool.close()
+	if c.agent != nil {
+		if errAgent := c.agent.Close(); err == nil {
+			err = errAgent
+		}
+	}
+	return err
+}
+
+// Copy is a reflux.Transfer uploading sourcePath to targetPath. A partial target left by a previous
+// attempt is appended to, the bytes it holds are checked with a remote stat. It returns the size of the target.
+// The target paths that are not absolute are relative to the BaseDir of the server.
+func (c *Client) Copy(sourcePath string, targetPath string) (int, error) {
+	offset, n, err := c.upload(context.Background(), sourcePath, targetPath, -1, nil)
+	return offset + n, err
+}
+
+// CopyFrom is a reflux.ResumableTransfer uploading sourcePath to targetPath from offset like reflux.CopyFileFrom.
+// The partial target must hold at least offset bytes, otherwise reflux.ErrOffsetMismatch is returned.
+// It returns the bytes written by the call, also when it fails.
+func (c *Client) CopyFrom(sourcePath string, targetPath string, offset int) (int, error) {
+	_, n, err := c.upload(context.Background(), sourcePath, targetPath, offset, nil)
+	return n, err
+}
+
+// CopyFromContext is a reflux.ResumableContextTransfer uploading sourcePath to targetPath like CopyFrom.
+// The upload stops once ctx is cancelled, the partial target is kept.
+func (c *Client) CopyFromContext(ctx context.Context, sourcePath string, targetPath string, offset int) (int, error) {
+	_, n, err := c.upload(ctx, sourcePath, targetPath, offset, nil)
+	return n, err
+}
+
+// CopyProgress is a reflux.ProgressTransfer uploading sourcePath to targetPath like Copy.
+// The bytes already held by the partial target are reported to progress first.
+func (c *Client) CopyProgress(ctx context.Context, sourcePath string, targetPath string, progress *reflux.Progress) (int, error) {
+	offset, n, err := c.upload(ctx, sourcePath, targetPath, -1, progress)
+	return offset + n, err
+}
+
+// remotePath returns the path of the target on the server.
+func (c *Client) remotePath(targetPath string) string {
+	targetPath = filepath.ToSlash(targetPath)
+	if path.IsAbs(targetPath) || c.info.BaseDir == "" {
+		return targetPath
+	}
+	return path.Join(c.info.BaseDir, targetPath)
+}
+
+// upload uploads sourcePath to the target from offset, or from the size of the partial target if offset is negative.
+// It returns the offset the upload started from and the bytes written. The progress is optional.
+func (c *Client) upload(ctx context.Context, sourcePath string, targetPath string, offset int, progress *reflux.Progress) (start int, n int, err error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		// A connection that failed may be broken, it is not reused.
+		c.pool.put(cn, err)
+	}()
+
+	target := c.remotePath(targetPath)
+	partial := target + reflux.PartialSuffix
+
+	if offset < 0 {
+		offset = 0
+		if stat, err := cn.sftp.Stat(partial); err == nil && stat.Size() <= info.Size() {
+			offset = int(stat.Size())
+		}
+	}
+	if int64(offset) > info.Size() {
+		return 0, 0, errors.Wrapf(reflux.ErrOffsetMismatch, "offset %d, source size %d", offset, info.Size())
+	}
+
+	// The previous attempt uploaded the whole file and was interrupted before the status was recorded
+	if offset > 0 && int64(offset) == info.Size() {
+		if stat, err := cn.sftp.Stat(target); err == nil && stat.Size() == info.Size() {
+			return offset, 0, nil
+		}
+	}
+
+	if err := cn.sftp.MkdirAll(path.Dir(target)); err != nil {
+		return offset, 0, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := cn.sftp.OpenFile(partial, flags)
+	if err != nil {
+		return offset, 0, err
+	}
+	defer file.Close()
+
+	if offset > 0 {
+		stat, err := file.Stat()
+		if err != nil {
+			return offset, 0, err
+		}
+		if stat.Size() < int64(offset) {
+			return offset, 0, errors.Wrapf(reflux.ErrOffsetMismatch, "offset %d, '%s' holds %d bytes", offset, partial, stat.Size())
+		}
+		if err := file.Truncate(int64(offset)); err != nil {
+			return offset, 0, err
+		}
+		if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+			return offset, 0, err
+		}
+		if _, err := source.Seek(int64(offset), io.SeekStart); err != nil {
+			return offset, 0, err
+		}
+		if progress != nil {
+			if err := progress.Add(offset); err != nil {
+				return offset, 0, err
+			}
+		}
+	}
+
+	if n, err = reflux.CopyChunks(ctx, file, source, progress); err != nil {
+		return offset, n, err
+	}
+
+	if err := file.Chmod(info.Mode().Perm()); err != nil {
+		return offset, n, err
+	}
+	if _, ok := cn.sftp.HasExtension(fsyncExtension); ok {
+		if err := file.Sync(); err != nil {
+			return offset, n, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return offset, n, err
+	}
+	if err := cn.sftp.Chtimes(partial, time.Now(), info.ModTime()); err != nil {
+		return offset, n, err
+	}
+	return offset, n, rename(cn.sftp, partial, target)
+}
+
+// rename renames the partial target over the target.
+func rename(client *sftp.Client, partial string, target string) error {
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		return client.PosixRename(partial, target)
+	}
+
+	// The plain rename fails if the target exists
+	if err := client.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(partial, target)
+}
+
+// dial opens an SFTP session to the server.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig, ioTimeout time.Duration) (*conn, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &timeoutConn{Conn: netConn, timeout: ioTimeout}
+	_ = netConn.SetDeadline(time.Now().Add(config.Timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(tc, addr, config)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	_ = netConn.SetDeadline(time.Time{})
+
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, err
+	}
+	return &conn{net: tc, ssh: sshClient, sftp: sftpClient}, nil
+}
@@ -0,0 +1,312 @@
+package sftptransfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/ro-ag/reflux.v0"
+	"gopkg.in/ro-ag/reflux.v0/sftptransfer"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote")
+	server := newServer(t, remote)
+
+	tm, err := reflux.NewTransferManager(reflux.WithLockFile(filepath.Join(dir, "sftp.lock")), reflux.WithSignalHandling(false))
+	if err != nil {
+		t.Fatalf("Failed to create TransferManager: %v", err)
+	}
+	defer func() {
+		if err := tm.Finish(); err != nil {
+			t.Errorf("Failed to finish TransferManager: %v", err)
+		}
+	}()
+
+	err = tm.StoreOrUpdateServerInfo(&reflux.ServerInfo{
+		Address: "127.0.0.1",
+		Port:    server.port,
+		User:    "user",
+		Scheme:  reflux.SchemeSFTP,
+		BaseDir: remote,
+		Auth:    reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "password"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to store server info: %v", err)
+	}
+
+	client, err := sftptransfer.FromManager(tm,
+		sftptransfer.WithHostKeyCallback(ssh.FixedHostKey(server.hostKey)),
+		sftptransfer.WithCredentials(func(id string) (ssh.AuthMethod, error) {
+			return ssh.Password("secret-" + id), nil
+		}),
+		sftptransfer.WithPoolSize(2),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	// Upload several files concurrently through the pooled connections
+	files := map[string][]byte{}
+	for i, name := range []string{"a.bin", "b.bin", "nested/c.bin", "d.bin"} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 300<<10+i)
+		sourcePath := filepath.Join(dir, "source", filepath.Base(name))
+		writeFile(t, sourcePath, data)
+		files[name] = data
+		if err := tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: name}); err != nil {
+			t.Fatalf("Failed to store file metadata: %v", err)
+		}
+	}
+
+	results, err := tm.Files.OperateConcurrent(context.Background(), client.Copy, 4)
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	for _, result := range results {
+		if result.Err != nil || result.Metadata.Status != reflux.StatusCompleted ||
+			result.Metadata.BytesTransferred != len(files[result.Metadata.TargetPath]) {
+			t.Errorf("Unexpected result: %+v, %v", result.Metadata, result.Err)
+		}
+	}
+	for name, data := range files {
+		checkRemote(t, filepath.Join(remote, name), data)
+	}
+	if n := server.conns.Load(); n > 2 {
+		t.Errorf("Opened %d connections, the pool is limited to 2", n)
+	}
+
+	// A partial target left by a crash is resumed from the recorded offset
+	sourcePath := filepath.Join(dir, "source", "a.bin")
+	target := filepath.Join(remote, "a.bin")
+	offset := 100 << 10
+	if err := os.Remove(target); err != nil {
+		t.Fatalf("Failed to remove target: %v", err)
+	}
+	writeFile(t, target+reflux.PartialSuffix, append(append([]byte{}, files["a.bin"][:offset]...), "garbage"...))
+	err = tm.Files.StoreOrUpdate(reflux.FileMetadata{SourcePath: sourcePath, TargetPath: "a.bin",
+		Status: reflux.StatusInterrupted, BytesTransferred: offset})
+	if err != nil {
+		t.Fatalf("Failed to store file metadata: %v", err)
+	}
+	if _, err := tm.Files.Resume(client.CopyFrom); err != nil {
+		t.Fatalf("Failed to resume: %v", err)
+	}
+	if meta, _ := tm.Files.Load(sourcePath); meta.Status != reflux.StatusCompleted || meta.BytesTransferred != len(files["a.bin"]) {
+		t.Errorf("Unexpected file metadata after resume: %s, %d bytes", meta.Status, meta.BytesTransferred)
+	}
+	checkRemote(t, target, files["a.bin"])
+
+	// Without a recorded offset the partial target is appended to after a remote stat
+	writeFile(t, target+reflux.PartialSuffix, files["a.bin"][:offset])
+	if n, err := client.Copy(sourcePath, "a.bin"); err != nil || n != len(files["a.bin"]) {
+		t.Errorf("Unexpected copy: %d, %v", n, err)
+	}
+	checkRemote(t, target, files["a.bin"])
+
+	// An offset past the partial target cannot be resumed
+	writeFile(t, target+reflux.PartialSuffix, files["a.bin"][:10])
+	if _, err := client.CopyFrom(sourcePath, "a.bin", offset); !errors.Is(err, reflux.ErrOffsetMismatch) {
+		t.Errorf("Expected ErrOffsetMismatch, got %v", err)
+	}
+
+	// A private key file authenticates the user
+	keyPath := filepath.Join(dir, "id_ed25519")
+	writeFile(t, keyPath, server.clientKey)
+	keyClient, err := sftptransfer.New(&reflux.ServerInfo{
+		Address: "127.0.0.1",
+		Port:    server.port,
+		User:    "user",
+		BaseDir: remote,
+		Auth:    reflux.AuthRef{Method: reflux.AuthKey, KeyPath: keyPath},
+	}, sftptransfer.WithHostKeyCallback(ssh.FixedHostKey(server.hostKey)))
+	if err != nil {
+		t.Fatalf("Failed to create client with key: %v", err)
+	}
+	if n, err := keyClient.Copy(filepath.Join(dir, "source", "b.bin"), "key/b.bin"); err != nil || n != len(files["b.bin"]) {
+		t.Errorf("Unexpected copy with key: %d, %v", n, err)
+	}
+	checkRemote(t, filepath.Join(remote, "key", "b.bin"), files["b.bin"])
+	if err := keyClient.Close(); err != nil {
+		t.Errorf("Failed to close client: %v", err)
+	}
+	if _, err := keyClient.Copy(sourcePath, "a.bin"); !errors.Is(err, sftptransfer.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	// Only the sftp servers are supported
+	if _, err := sftptransfer.New(&reflux.ServerInfo{Address: "localhost", Port: 443, User: "user", Scheme: reflux.SchemeHTTPS},
+		sftptransfer.WithHostKeyCallback(ssh.InsecureIgnoreHostKey())); !errors.Is(err, sftptransfer.ErrUnsupportedScheme) {
+		t.Errorf("Expected ErrUnsupportedScheme, got %v", err)
+	}
+	if _, err := sftptransfer.New(&reflux.ServerInfo{Address: "localhost", Port: 22, User: "user",
+		Auth: reflux.AuthRef{Method: reflux.AuthCredential, CredentialID: "id"}},
+		sftptransfer.WithHostKeyCallback(ssh.InsecureIgnoreHostKey())); !errors.Is(err, sftptransfer.ErrNoCredentials) {
+		t.Errorf("Expected ErrNoCredentials, got %v", err)
+	}
+}
+
+// testServer is an SFTP server listening on localhost.
+type testServer struct {
+	port      int
+	hostKey   ssh.PublicKey
+	clientKey []byte       // The PEM encoded private key accepted by the server
+	conns     atomic.Int32 // The number of connections accepted
+}
+
+// newServer starts an SFTP server serving root, accepting the password "secret-password" and the client key.
+func newServer(t *testing.T, root string) *testServer {
+	t.Helper()
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatalf("Failed to create server root: %v", err)
+	}
+
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(clientPrivate)
+	if err != nil {
+		t.Fatalf("Failed to marshal client key: %v", err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatalf("Failed to create client public key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "user" && string(password) == "secret-password" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == "user" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	s := &testServer{
+		port:      listener.Addr().(*net.TCPAddr).Port,
+		hostKey:   hostSigner.PublicKey(),
+		clientKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config, root)
+		}
+	}()
+	return s
+}
+
+// serve serves the SFTP sessions of a connection.
+func (s *testServer) serve(netConn net.Conn, config *ssh.ServerConfig, root string) {
+	defer netConn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		return
+	}
+	s.conns.Add(1)
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// The payload of the subsystem request is the length prefixed name of the subsystem
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				go func() {
+					defer channel.Close()
+					server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+					if err != nil {
+						return
+					}
+					_ = server.Serve()
+				}()
+			}
+		}()
+	}
+}
+
+// writeFile writes the file, creating its directory.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	modTime := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+}
+
+// checkRemote checks the content, the mode and the modification time of an uploaded file.
+func checkRemote(t *testing.T, path string, data []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Remote file '%s' differs: %d bytes, %v", path, len(got), err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat remote file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Remote file '%s' mode or time not preserved: %v, %v", path, info.Mode(), info.ModTime())
+	}
+	if _, err := os.Stat(path + reflux.PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("Partial target of '%s' left: %v", path, err)
+	}
+}
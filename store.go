@@ -0,0 +1,185 @@
+package reflux
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+// Store is the storage backend of a TransferManager.
+// It is a transactional key-value store organized in nested buckets, modelled after BoltDB.
+type Store interface {
+	// View executes fn within a read-only transaction.
+	View(fn func(tx Tx) error) error
+
+	// Update executes fn within a read-write transaction.
+	// The transaction is committed if fn returns nil and rolled back otherwise.
+	Update(fn func(tx Tx) error) error
+
+	// Sync flushes the committed transactions to the underlying storage.
+	Sync() error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Tx is a transaction of a Store.
+type Tx interface {
+	// Bucket returns the top level bucket with the given name, nil if it does not exist.
+	Bucket(name []byte) Bucket
+
+	// CreateBucketIfNotExists returns the top level bucket with the given name, creating it if needed.
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+
+	// DeleteBucket deletes the top level bucket with the given name.
+	DeleteBucket(name []byte) error
+}
+
+// Bucket is a collection of key-value pairs and nested buckets.
+// The values returned by the bucket are only valid during the transaction.
+type Bucket interface {
+	// Get returns the value of the given key, nil if it does not exist.
+	Get(key []byte) []byte
+
+	// Put sets the value of the given key.
+	Put(key []byte, value []byte) error
+
+	// Delete deletes the given key.
+	Delete(key []byte) error
+
+	// ForEach calls fn for every key-value pair of the bucket, in key order.
+	// The value of a nested bucket is nil.
+	ForEach(fn func(k, v []byte) error) error
+
+	// NextSequence returns an auto-incrementing integer for the bucket.
+	NextSequence() (uint64, error)
+
+	// Bucket returns the nested bucket with the given name, nil if it does not exist.
+	Bucket(name []byte) Bucket
+
+	// CreateBucketIfNotExists returns the nested bucket with the given name, creating it if needed.
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+
+	// DeleteBucket deletes the nested bucket with the given name.
+	DeleteBucket(name []byte) error
+}
+
+// boltStore is the Store backed by a BoltDB database, the default of the TransferManager.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the BoltDB database at path, creating it with the given mode if needed.
+// The timeout is the amount of time to wait to obtain the file lock, 0 waits indefinitely.
+func OpenBoltStore(path string, mode os.FileMode, timeout time.Duration) (Store, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// View executes fn within a read-only transaction.
+func (s *boltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+// Update executes fn within a read-write transaction.
+func (s *boltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
+
+// Sync flushes the database to disk.
+func (s *boltStore) Sync() error {
+	return s.db.Sync()
+}
+
+// Close closes the database.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx is the Tx of a boltStore.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// Bucket returns the top level bucket with the given name, nil if it does not exist.
+func (t boltTx) Bucket(name []byte) Bucket {
+	return wrapBoltBucket(t.tx.Bucket(name))
+}
+
+// CreateBucketIfNotExists returns the top level bucket with the given name, creating it if needed.
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapBoltBucket(b), nil
+}
+
+// DeleteBucket deletes the top level bucket with the given name.
+func (t boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+// boltBucket is the Bucket of a boltStore.
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBoltBucket returns the Bucket wrapping b, nil if b is nil.
+func wrapBoltBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b: b}
+}
+
+// Get returns the value of the given key, nil if it does not exist.
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+// Put sets the value of the given key.
+func (b boltBucket) Put(key []byte, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+// Delete deletes the given key.
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+// ForEach calls fn for every key-value pair of the bucket, in key order.
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+// NextSequence returns an auto-incrementing integer for the bucket.
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+// Bucket returns the nested bucket with the given name, nil if it does not exist.
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return wrapBoltBucket(b.b.Bucket(name))
+}
+
+// CreateBucketIfNotExists returns the nested bucket with the given name, creating it if needed.
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapBoltBucket(nested), nil
+}
+
+// DeleteBucket deletes the nested bucket with the given name.
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
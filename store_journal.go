@@ -0,0 +1,301 @@
+package reflux
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+const (
+	journalMagic       = "RFJ\x01" // The header of a journal file, with the version of its format
+	journalFrameHeader = 8         // The size of the length and the CRC-32 preceding each transaction
+)
+
+// The kinds of the changes recorded in a journal.
+const (
+	opPut byte = iota + 1
+	opDelete
+	opSequence
+	opCreateBucket
+	opDeleteBucket
+)
+
+var (
+	ErrNotJournal     = errors.New("not a journal file")
+	ErrCorruptJournal = errors.New("corrupt journal file")
+)
+
+// journalOp is a change made by a read-write transaction.
+type journalOp struct {
+	kind     byte
+	path     []string // The bucket changed, or the bucket created or deleted
+	key      string
+	value    []byte
+	sequence uint64
+}
+
+// journal is the file a journaled memoryStore appends its committed transactions to.
+type journal struct {
+	f    *os.File
+	size int64 // The size of the file once the last transaction was written
+}
+
+// OpenJournalStore opens the journal file at path, creating it with the given mode if needed, and returns a
+// Store kept in memory that appends every committed transaction to the file. It is written in pure Go and
+// uses neither BoltDB nor cgo. The transactions of the file are replayed when it is opened, then the file is
+// compacted to the current content of the store. A transaction cut short by a crash is discarded.
+// The file is not locked, it must not be opened by two processes at a time.
+func OpenJournalStore(path string, mode os.FileMode) (Store, error) {
+	root := newMemoryBucket()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := replayJournal(root, data); err != nil {
+			return nil, errors.Wrapf(err, "'%s'", path)
+		}
+	}
+
+	// The compacted journal replaces the file once it is complete
+	tmp := path + ".tmp"
+	compacted := append([]byte(journalMagic), journalFrame(snapshotOps(root, nil, nil))...)
+	if err := writeFileSync(tmp, compacted, mode); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryStore{root: root, journal: &journal{f: f, size: int64(len(compacted))}}, nil
+}
+
+// append writes the changes of a transaction to the file. On failure the file is truncated to its
+// previous size, the transaction is not committed.
+func (j *journal) append(ops []journalOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	frame := journalFrame(ops)
+	_, err := j.f.Write(frame)
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		_ = j.f.Truncate(j.size)
+		return errors.Wrap(err, "failed to write journal")
+	}
+	j.size += int64(len(frame))
+	return nil
+}
+
+// sync flushes the file to disk.
+func (j *journal) sync() error {
+	return j.f.Sync()
+}
+
+// close closes the file.
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// writeFileSync writes data to the file at path and flushes it to disk.
+func writeFileSync(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// snapshotOps appends to ops the changes creating the content of the bucket at path.
+func snapshotOps(b *memoryBucket, path []string, ops []journalOp) []journalOp {
+	if len(path) > 0 {
+		ops = append(ops, journalOp{kind: opCreateBucket, path: path})
+	}
+	if b.sequence > 0 {
+		ops = append(ops, journalOp{kind: opSequence, path: path, sequence: b.sequence})
+	}
+
+	keys := make([]string, 0, len(b.values))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ops = append(ops, journalOp{kind: opPut, path: path, key: k, value: b.values[k]})
+	}
+
+	names := make([]string, 0, len(b.buckets))
+	for name := range b.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nested := append(append(make([]string, 0, len(path)+1), path...), name)
+		ops = snapshotOps(b.buckets[name], nested, ops)
+	}
+	return ops
+}
+
+// journalFrame encodes the changes of a transaction, preceded by their length and their CRC-32.
+func journalFrame(ops []journalOp) []byte {
+	frame := make([]byte, journalFrameHeader)
+	for _, op := range ops {
+		frame = append(frame, op.kind)
+		frame = binary.AppendUvarint(frame, uint64(len(op.path)))
+		for _, name := range op.path {
+			frame = appendJournalBytes(frame, []byte(name))
+		}
+		switch op.kind {
+		case opPut:
+			frame = appendJournalBytes(frame, []byte(op.key))
+			frame = appendJournalBytes(frame, op.value)
+		case opDelete:
+			frame = appendJournalBytes(frame, []byte(op.key))
+		case opSequence:
+			frame = binary.AppendUvarint(frame, op.sequence)
+		}
+	}
+	payload := frame[journalFrameHeader:]
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return frame
+}
+
+// appendJournalBytes appends b preceded by its length.
+func appendJournalBytes(frame []byte, b []byte) []byte {
+	frame = binary.AppendUvarint(frame, uint64(len(b)))
+	return append(frame, b...)
+}
+
+// replayJournal applies the transactions of a journal file to root.
+// The last transaction is discarded if the file ends before it does.
+func replayJournal(root *memoryBucket, data []byte) error {
+	if len(data) < len(journalMagic) || string(data[:len(journalMagic)]) != journalMagic {
+		return ErrNotJournal
+	}
+	data = data[len(journalMagic):]
+
+	for len(data) >= journalFrameHeader {
+		size := int(binary.BigEndian.Uint32(data[0:4]))
+		if len(data)-journalFrameHeader < size {
+			return nil
+		}
+		payload := data[journalFrameHeader : journalFrameHeader+size]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+			return ErrCorruptJournal
+		}
+		if err := replayFrame(root, payload); err != nil {
+			return err
+		}
+		data = data[journalFrameHeader+size:]
+	}
+	return nil
+}
+
+// replayFrame applies the changes of a transaction to root.
+func replayFrame(root *memoryBucket, payload []byte) error {
+	r := journalReader{data: payload}
+	for len(r.data) > 0 {
+		kind, depth := r.byte(), r.uvarint()
+		if depth > uint64(len(r.data)) {
+			return ErrCorruptJournal
+		}
+		path := make([]string, depth)
+		for i := range path {
+			path[i] = string(r.bytes())
+		}
+		if r.err {
+			return ErrCorruptJournal
+		}
+
+		parent := path
+		if kind == opCreateBucket || kind == opDeleteBucket {
+			if len(path) == 0 {
+				return ErrCorruptJournal
+			}
+			parent = path[:len(path)-1]
+		}
+		b := root
+		for _, name := range parent {
+			if b = b.buckets[name]; b == nil {
+				return ErrCorruptJournal
+			}
+		}
+
+		switch kind {
+		case opPut:
+			key, value := string(r.bytes()), r.bytes()
+			b.values[key] = value
+		case opDelete:
+			delete(b.values, string(r.bytes()))
+		case opSequence:
+			b.sequence = r.uvarint()
+		case opCreateBucket:
+			b.buckets[path[len(path)-1]] = newMemoryBucket()
+		case opDeleteBucket:
+			delete(b.buckets, path[len(path)-1])
+		default:
+			return ErrCorruptJournal
+		}
+		if r.err {
+			return ErrCorruptJournal
+		}
+	}
+	return nil
+}
+
+// journalReader decodes the changes of a transaction. err is set once the data is too short.
+type journalReader struct {
+	data []byte
+	err  bool
+}
+
+// byte reads a byte.
+func (r *journalReader) byte() byte {
+	if len(r.data) == 0 {
+		r.err = true
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+// uvarint reads an unsigned varint.
+func (r *journalReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = true
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// bytes reads a byte slice preceded by its length.
+func (r *journalReader) bytes() []byte {
+	size := r.uvarint()
+	if r.err || uint64(len(r.data)) < size {
+		r.err = true
+		return nil
+	}
+	b := r.data[:size:size]
+	r.data = r.data[size:]
+	return b
+}
@@ -0,0 +1,294 @@
+package reflux
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+)
+
+// memoryStore is a Store keeping the buckets in memory, nothing is written to the filesystem but its journal.
+// The read-write transactions copy the buckets they touch, the copies replace them on commit.
+type memoryStore struct {
+	mu      sync.RWMutex
+	root    *memoryBucket // The top level buckets
+	journal *journal      // Records the committed transactions, nil if the store is not persisted
+	closed  bool
+}
+
+// NewMemoryStore returns an empty Store kept in memory.
+// It is meant for tests and short-lived jobs, its content is lost when the process stops.
+// It returns the same errors as the BoltDB store.
+func NewMemoryStore() Store {
+	return &memoryStore{root: newMemoryBucket()}
+}
+
+// View executes fn within a read-only transaction.
+func (s *memoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+	return fn(memoryTx{root: memoryBucketRef{b: s.root}})
+}
+
+// Update executes fn within a read-write transaction.
+func (s *memoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+
+	w := &memoryWrite{owned: make(map[*memoryBucket]bool), journaled: s.journal != nil}
+	root := w.own(s.root)
+	if err := fn(memoryTx{root: memoryBucketRef{b: root, w: w}}); err != nil {
+		return err
+	}
+	if s.journal != nil {
+		if err := s.journal.append(w.ops); err != nil {
+			return err
+		}
+	}
+	s.root = root
+	return nil
+}
+
+// Sync flushes the journal, the committed transactions are already in memory.
+func (s *memoryStore) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+	if s.journal != nil {
+		return s.journal.sync()
+	}
+	return nil
+}
+
+// Close discards the buckets and closes the journal.
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.root = nil
+	if s.journal != nil {
+		return s.journal.close()
+	}
+	return nil
+}
+
+// memoryWrite is the state of a read-write transaction of a memoryStore.
+type memoryWrite struct {
+	owned     map[*memoryBucket]bool // The buckets copied or created by the transaction, modified in place
+	journaled bool                   // Whether the changes are recorded in ops
+	ops       []journalOp            // The changes of the transaction, in order
+}
+
+// own returns a copy of the bucket that the transaction can modify, the bucket itself if it was already copied.
+func (w *memoryWrite) own(b *memoryBucket) *memoryBucket {
+	if w.owned[b] {
+		return b
+	}
+	c := b.copy()
+	w.owned[c] = true
+	return c
+}
+
+// record records a change of the transaction.
+func (w *memoryWrite) record(op journalOp) {
+	if w.journaled {
+		w.ops = append(w.ops, op)
+	}
+}
+
+// memoryTx is the Tx of a memoryStore.
+type memoryTx struct {
+	root memoryBucketRef
+}
+
+// Bucket returns the top level bucket with the given name, nil if it does not exist.
+func (t memoryTx) Bucket(name []byte) Bucket {
+	return t.root.Bucket(name)
+}
+
+// CreateBucketIfNotExists returns the top level bucket with the given name, creating it if needed.
+func (t memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return t.root.CreateBucketIfNotExists(name)
+}
+
+// DeleteBucket deletes the top level bucket with the given name.
+func (t memoryTx) DeleteBucket(name []byte) error {
+	return t.root.DeleteBucket(name)
+}
+
+// memoryBucket holds the key-value pairs and the nested buckets of a bucket.
+// The values are never modified once stored, so they are shared between copies.
+type memoryBucket struct {
+	values   map[string][]byte
+	buckets  map[string]*memoryBucket
+	sequence uint64
+}
+
+// newMemoryBucket returns an empty bucket.
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+// copy returns a copy of the bucket sharing its values and its nested buckets.
+func (b *memoryBucket) copy() *memoryBucket {
+	c := &memoryBucket{
+		values:   make(map[string][]byte, len(b.values)),
+		buckets:  make(map[string]*memoryBucket, len(b.buckets)),
+		sequence: b.sequence,
+	}
+	for k, v := range b.values {
+		c.values[k] = v
+	}
+	for k, nested := range b.buckets {
+		c.buckets[k] = nested
+	}
+	return c
+}
+
+// memoryBucketRef is the Bucket of a memoryStore within a transaction.
+// In a read-write transaction, the bucket is owned by the transaction.
+type memoryBucketRef struct {
+	b    *memoryBucket
+	w    *memoryWrite // The state of the read-write transaction, nil if the transaction is read-only
+	path []string     // The names of the bucket and its parents, from the top level
+}
+
+// nested returns the path of the nested bucket with the given name.
+func (r memoryBucketRef) nested(name string) []string {
+	return append(append(make([]string, 0, len(r.path)+1), r.path...), name)
+}
+
+// Get returns the value of the given key, nil if it does not exist.
+func (r memoryBucketRef) Get(key []byte) []byte {
+	v, ok := r.b.values[string(key)]
+	if !ok {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+// Put sets the value of the given key.
+func (r memoryBucketRef) Put(key []byte, value []byte) error {
+	switch {
+	case r.w == nil:
+		return bolt.ErrTxNotWritable
+	case len(key) == 0:
+		return bolt.ErrKeyRequired
+	case r.b.buckets[string(key)] != nil:
+		return bolt.ErrIncompatibleValue
+	}
+	value = append([]byte{}, value...)
+	r.b.values[string(key)] = value
+	r.w.record(journalOp{kind: opPut, path: r.path, key: string(key), value: value})
+	return nil
+}
+
+// Delete deletes the given key.
+func (r memoryBucketRef) Delete(key []byte) error {
+	switch {
+	case r.w == nil:
+		return bolt.ErrTxNotWritable
+	case r.b.buckets[string(key)] != nil:
+		return bolt.ErrIncompatibleValue
+	}
+	if _, ok := r.b.values[string(key)]; ok {
+		delete(r.b.values, string(key))
+		r.w.record(journalOp{kind: opDelete, path: r.path, key: string(key)})
+	}
+	return nil
+}
+
+// ForEach calls fn for every key-value pair of the bucket, in key order.
+func (r memoryBucketRef) ForEach(fn func(k, v []byte) error) error {
+	keys := make([]string, 0, len(r.b.values)+len(r.b.buckets))
+	for k := range r.b.values {
+		keys = append(keys, k)
+	}
+	for k := range r.b.buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), r.Get([]byte(k))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextSequence returns an auto-incrementing integer for the bucket.
+func (r memoryBucketRef) NextSequence() (uint64, error) {
+	if r.w == nil {
+		return 0, bolt.ErrTxNotWritable
+	}
+	r.b.sequence++
+	r.w.record(journalOp{kind: opSequence, path: r.path, sequence: r.b.sequence})
+	return r.b.sequence, nil
+}
+
+// Bucket returns the nested bucket with the given name, nil if it does not exist.
+// In a read-write transaction, the bucket is copied the first time it is returned.
+func (r memoryBucketRef) Bucket(name []byte) Bucket {
+	nested, ok := r.b.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	if r.w != nil {
+		nested = r.w.own(nested)
+		r.b.buckets[string(name)] = nested
+	}
+	return memoryBucketRef{b: nested, w: r.w, path: r.nested(string(name))}
+}
+
+// CreateBucketIfNotExists returns the nested bucket with the given name, creating it if needed.
+func (r memoryBucketRef) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if nested := r.Bucket(name); nested != nil {
+		return nested, nil
+	}
+
+	switch {
+	case r.w == nil:
+		return nil, bolt.ErrTxNotWritable
+	case len(name) == 0:
+		return nil, bolt.ErrBucketNameRequired
+	case r.b.values[string(name)] != nil:
+		return nil, bolt.ErrIncompatibleValue
+	}
+
+	nested := newMemoryBucket()
+	r.w.owned[nested] = true
+	r.b.buckets[string(name)] = nested
+	r.w.record(journalOp{kind: opCreateBucket, path: r.nested(string(name))})
+	return memoryBucketRef{b: nested, w: r.w, path: r.nested(string(name))}, nil
+}
+
+// DeleteBucket deletes the nested bucket with the given name.
+func (r memoryBucketRef) DeleteBucket(name []byte) error {
+	switch {
+	case r.w == nil:
+		return bolt.ErrTxNotWritable
+	case r.b.buckets[string(name)] == nil:
+		return bolt.ErrBucketNotFound
+	}
+	delete(r.b.buckets, string(name))
+	r.w.record(journalOp{kind: opDeleteBucket, path: r.nested(string(name))})
+	return nil
+}
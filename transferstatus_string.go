@@ -12,11 +12,12 @@ func _() {
 	_ = x[StatusInProgress-1]
 	_ = x[StatusCompleted-2]
 	_ = x[StatusFailed-3]
+	_ = x[StatusInterrupted-4]
 }
 
-const _TransferStatus_name = "StatusNotStartedStatusInProgressStatusCompletedStatusFailed"
+const _TransferStatus_name = "StatusNotStartedStatusInProgressStatusCompletedStatusFailedStatusInterrupted"
 
-var _TransferStatus_index = [...]uint8{0, 16, 32, 47, 59}
+var _TransferStatus_index = [...]uint8{0, 16, 32, 47, 59, 76}
 
 func (i TransferStatus) String() string {
 	if i >= TransferStatus(len(_TransferStatus_index)-1) {
@@ -0,0 +1,107 @@
+package reflux
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// transitions holds the statuses each status can move to.
+// A completed file can only be marked as failed, when its verification fails, or be reset.
+var transitions = map[TransferStatus][]TransferStatus{
+	StatusNotStarted:  {StatusInProgress},
+	StatusInProgress:  {StatusInProgress, StatusCompleted, StatusFailed, StatusInterrupted},
+	StatusCompleted:   {StatusFailed},
+	StatusFailed:      {StatusInProgress},
+	StatusInterrupted: {StatusInProgress},
+}
+
+// CanTransition returns whether a file can move from the status s to the status next.
+func (s TransferStatus) CanTransition(next TransferStatus) bool {
+	for _, status := range transitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// transition returns the metadata moved to the given status with its fields normalized.
+// Starting a transfer clears the end time, the error and the attempts, completing it clears the error.
+func (meta FileMetadata) transition(status TransferStatus, bytesTransferred int, err error) (FileMetadata, error) {
+	if !meta.Status.CanTransition(status) {
+		return meta, errors.Wrapf(ErrInvalidTransition, "'%s' from %s to %s", meta.SourcePath, meta.Status, status)
+	}
+
+	meta.Status = status
+	meta.BytesTransferred = bytesTransferred
+	meta.ErrorMsg = ""
+	if err != nil && (status == StatusFailed || status == StatusInterrupted) {
+		meta.ErrorMsg = err.Error()
+	}
+
+	switch status {
+	case StatusInProgress:
+		meta.TimeStart = time.Now()
+		meta.TimeEnd = time.Time{}
+		meta.Attempts = 0
+	case StatusCompleted, StatusFailed, StatusInterrupted:
+		meta.TimeEnd = time.Now()
+	}
+
+	return meta, nil
+}
+
+// reset returns the metadata of the file as if it was never transferred.
+// The fingerprint of the source file is kept.
+func (meta FileMetadata) reset() FileMetadata {
+	return FileMetadata{
+		SourcePath: meta.SourcePath,
+		TargetPath: meta.TargetPath,
+		Status:     StatusNotStarted,
+		Size:       meta.Size,
+		ModTime:    meta.ModTime,
+		Inode:      meta.Inode,
+		Checksum:   meta.Checksum,
+		Server:     meta.Server,
+	}
+}
+
+// Reset moves the file metadata for the given source path back to a clean StatusNotStarted,
+// discarding the bytes transferred, the times, the error and the attempts. The attributes of the file are kept.
+// The reset is recorded in the history of the file.
+func (fmm *fileMetadataMap) Reset(sourcePath string) error {
+	defer fmm.progress.notify(fmm)
+
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
+	meta, ok := fmm.Load(sourcePath)
+	if !ok {
+		return errors.Errorf("'%s' file key not found in map", sourcePath)
+	}
+	return fmm.resetFile(meta.reset())
+}
+
+// resetFile stores the given reset metadata stamped with the current run, discards the attempts of the last
+// transfer and appends the reset to the history of the file. The caller must hold fmm.mu.
+func (fmm *fileMetadataMap) resetFile(meta FileMetadata) error {
+	meta.RunID = fmm.runID
+
+	err := fmm.db.Update(func(tx Tx) error {
+		if err := fmm.putFile(tx, meta); err != nil {
+			return err
+		}
+		if err := deleteAttempts(tx, meta.key()); err != nil {
+			return err
+		}
+		return fmm.appendHistory(tx, meta, 0)
+	})
+	if err != nil {
+		return err
+	}
+	fmm.m.Store(meta.key(), meta)
+
+	return nil
+}
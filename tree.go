@@ -0,0 +1,228 @@
+package reflux
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SymlinkPolicy is how EnqueueTree handles the symbolic links found in the tree.
+type SymlinkPolicy int
+
+const (
+	SymlinkSkip   SymlinkPolicy = iota // The links are ignored
+	SymlinkFollow                      // The links are followed, except the links to a directory being walked
+	SymlinkReject                      // A link fails the walk with ErrSymlink
+)
+
+var ErrSymlink = errors.New("symbolic link in tree")
+
+// TreeOptions selects the files enqueued by EnqueueTree. The zero value enqueues every regular file
+// and skips the symbolic links.
+//
+// The patterns are matched against the path of the file relative to the root, with slashes: "**" matches any
+// number of directories and a pattern without a slash matches the name of the file in any directory.
+type TreeOptions struct {
+	Include  []string      // The patterns of the files to enqueue, every file if empty
+	Exclude  []string      // The patterns of the files and directories to skip, the excluded directories are not walked
+	MinSize  int64         // The minimum size of the files in bytes
+	MaxSize  int64         // The maximum size of the files in bytes, 0 means no bound
+	MinAge   time.Duration // The minimum time since the files were modified, to skip the files still being written
+	MaxAge   time.Duration // The maximum time since the files were modified, 0 means no bound
+	Symlinks SymlinkPolicy // How the symbolic links are handled
+}
+
+// validate checks the patterns of the options.
+func (o TreeOptions) validate() error {
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// selected returns whether a file of the given relative path and info is enqueued.
+func (o TreeOptions) selected(rel string, info os.FileInfo, now time.Time) bool {
+	if !info.Mode().IsRegular() || matchAny(o.Exclude, rel) {
+		return false
+	}
+	if len(o.Include) > 0 && !matchAny(o.Include, rel) {
+		return false
+	}
+	if info.Size() < o.MinSize || o.MaxSize > 0 && info.Size() > o.MaxSize {
+		return false
+	}
+	age := now.Sub(info.ModTime())
+	return age >= o.MinAge && (o.MaxAge == 0 || age <= o.MaxAge)
+}
+
+// matchAny returns whether the relative path matches one of the patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches the segments of a path with the segments of a pattern, "**" matching any number of them.
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// EnqueueTree walks srcRoot and stores the metadata of the files selected by opts, the target path of a file
+// being its path relative to srcRoot joined to dstRoot. dstRoot is a slash-separated path, like the remote paths
+// of the servers, the target paths use slashes whatever the local OS. The files already known keep their state, so the tree
+// can be enqueued again to pick up the new files. It returns the files added, with the fingerprint of their source.
+func (fmm *fileMetadataMap) EnqueueTree(srcRoot string, dstRoot string, opts TreeOptions) ([]FileMetadata, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	root, err := os.Stat(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !root.IsDir() {
+		return nil, errors.Errorf("'%s' is not a directory", srcRoot)
+	}
+
+	w := &treeWalker{fmm: fmm, opts: opts, dstRoot: dstRoot, now: time.Now(), walking: make(map[string]bool)}
+	if err := w.walk(filepath.Clean(srcRoot), ""); err != nil {
+		return nil, err
+	}
+	if len(w.added) == 0 {
+		return w.added, nil
+	}
+
+	fmm.mu.Lock()
+	defer fmm.mu.Unlock()
+
+	// The files enqueued concurrently since the walk keep their state
+	added := w.added[:0]
+	for _, meta := range w.added {
+		if _, ok := fmm.Load(meta.SourcePath); !ok {
+			added = append(added, meta)
+		}
+	}
+	err = fmm.db.Update(func(tx Tx) error {
+		for _, meta := range added {
+			if err := fmm.putFile(tx, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range added {
+		fmm.m.Store(meta.key(), meta)
+	}
+	return added, nil
+}
+
+// treeWalker collects the files of a tree that are not known yet.
+type treeWalker struct {
+	fmm     *fileMetadataMap
+	opts    TreeOptions
+	dstRoot string
+	now     time.Time       // The time the ages of the files are computed from
+	walking map[string]bool // The real paths of the directories being walked, to break the cycles of links
+	added   []FileMetadata  // The files to add
+}
+
+// walk walks the directory of the given relative path, empty for the root.
+func (w *treeWalker) walk(dir string, rel string) error {
+	if err := w.fmm.ctx.Err(); err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if w.walking[resolved] {
+		return nil
+	}
+	w.walking[resolved] = true
+	defer delete(w.walking, resolved)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		sourcePath := filepath.Join(dir, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch w.opts.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkReject:
+				return errors.Wrap(ErrSymlink, sourcePath)
+			}
+			if info, err = os.Stat(sourcePath); err != nil {
+				return errors.Wrapf(err, "failed to follow '%s'", sourcePath)
+			}
+		}
+
+		if info.IsDir() {
+			if matchAny(w.opts.Exclude, entryRel) {
+				continue
+			}
+			if err := w.walk(sourcePath, entryRel); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !w.opts.selected(entryRel, info, w.now) {
+			continue
+		}
+		if _, ok := w.fmm.Load(sourcePath); ok {
+			continue
+		}
+		w.added = append(w.added, FileMetadata{
+			SourcePath: sourcePath,
+			TargetPath: path.Join(w.dstRoot, entryRel),
+			Status:     StatusNotStarted,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			Inode:      inode(info),
+			Server:     w.fmm.server,
+		})
+	}
+	return nil
+}